@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policies used to pick the upstream a request is sent to.
+const (
+	roundRobin = "round_robin"
+	leastConns = "least_conn"
+	randomPick = "random"
+	ipHash     = "ip_hash"
+	weighted   = "weighted"
+)
+
+var errNoUpstream = errors.New("no upstream available")
+
+// upstream is one of the servers a proxy route sends requests to. Upstreams
+// are taken out of rotation while their health check is failing, and for a
+// while after too many requests to them fail in a row.
+type upstream struct {
+	active int64
+	url    *url.URL
+	weight int
+
+	mu               sync.Mutex
+	down             bool
+	fails            int
+	ejectedUntil     time.Time
+	breakerFails     int
+	breakerOpenUntil time.Time
+	probing          bool
+}
+
+// pool picks the upstream every request is sent to, according to its policy,
+// and sends it using the route's transport. It is the transport of the
+// route's reverse proxy. Requests that can be sent again are sent to another
+// upstream when the one that was picked could not be connected to, and are
+// retried as configured when they fail.
+type pool struct {
+	next      uint64
+	path      string
+	upstreams []*upstream
+	opts      proxyOptions
+	transport http.RoundTripper
+	trusted   []*net.IPNet
+	proxy     *httputil.ReverseProxy
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	mu      sync.Mutex
+	current []int
+}
+
+// Creates a pool for the upstreams of a route. The pool's health checks, if
+// it has any, run until the pool is stopped or the context is cancelled.
+func newPool(ctx context.Context, path string, targets []string, opts proxyOptions,
+	transport http.RoundTripper, trusted []*net.IPNet) (*pool, error) {
+
+	p := &pool{
+		path:      path,
+		opts:      opts,
+		transport: transport,
+		trusted:   trusted,
+		current:   make([]int, len(targets)),
+	}
+
+	for i, target := range targets {
+		u, err := parseUpstreamURL(target)
+
+		if err != nil {
+			return nil, err
+		}
+
+		weight := 1
+
+		if i < len(opts.weights) {
+			weight = opts.weights[i]
+		}
+
+		p.upstreams = append(p.upstreams, &upstream{url: u, weight: weight})
+	}
+
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	registry.add(p)
+
+	if opts.healthPath != "" {
+		go p.check()
+	}
+
+	return p, nil
+}
+
+func parseUpstreamURL(target string) (*url.URL, error) {
+	u, err := url.Parse(target)
+
+	if err != nil {
+		return nil, fmt.Errorf("error parsing proxy url (%v): %v", target, err)
+	} else if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("expecting an absolute proxy url but found %v", target)
+	}
+
+	return u, nil
+}
+
+func (p *pool) stop() {
+	p.cancel()
+}
+
+func (p *pool) RoundTrip(r *http.Request) (*http.Response, error) {
+	body, replayable := p.buffer(r)
+	tried := make(map[*upstream]bool)
+	lastErr := errNoUpstream
+	retries := 0
+
+	for {
+		u := p.pick(r, tried)
+
+		if u == nil {
+			return nil, lastErr
+		}
+
+		tried[u] = true
+
+		if !u.allow(p.opts) {
+			if lastErr == errNoUpstream {
+				lastErr = errCircuitOpen
+			}
+
+			continue
+		}
+
+		if body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		res, err := u.roundTrip(p.transport, r)
+
+		if r.Context().Err() != nil {
+			u.abandon()
+			return res, err
+		}
+
+		u.report(!failed(res, err), p.opts)
+
+		if err != nil {
+			lastErr = err
+		}
+
+		if err != nil && replayable && isDialError(err) && p.untried(tried) {
+			warn("error connecting to %v, trying another upstream: %v", u.url.Host, err)
+			continue
+		} else if retries >= p.opts.retries || !replayable || !p.retryable(r, res, err) {
+			return res, err
+		}
+
+		retries++
+		warn("retrying request to %v (%d of %d): %v", u.url, retries, p.opts.retries, describe(res, err))
+
+		if res != nil {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		if !p.untried(tried) {
+			tried = make(map[*upstream]bool)
+		}
+
+		if err := backoff(r.Context(), p.opts.retryBackoff, retries); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Checks if any upstream has not been tried yet.
+func (p *pool) untried(tried map[*upstream]bool) bool {
+	return len(tried) < len(p.upstreams)
+}
+
+// Returns the upstream the request should be sent to, leaving out the ones
+// that were already tried. Upstreams that are out of rotation are only picked
+// when every upstream that is left is out of rotation.
+func (p *pool) pick(r *http.Request, tried map[*upstream]bool) *upstream {
+	var candidates []*upstream
+	var unavailable []*upstream
+	now := time.Now()
+
+	for _, u := range p.upstreams {
+		if tried[u] {
+			continue
+		} else if u.available(now) {
+			candidates = append(candidates, u)
+		} else {
+			unavailable = append(unavailable, u)
+		}
+	}
+
+	if len(candidates) == 0 {
+		candidates = unavailable
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch p.opts.policy {
+	case leastConns:
+		// Ties are broken by starting from a different upstream every time.
+		start := int(atomic.AddUint64(&p.next, 1) % uint64(len(candidates)))
+		best := candidates[start]
+
+		for i := 1; i < len(candidates); i++ {
+			u := candidates[(start+i)%len(candidates)]
+
+			if atomic.LoadInt64(&u.active) < atomic.LoadInt64(&best.active) {
+				best = u
+			}
+		}
+
+		return best
+
+	case randomPick:
+		return candidates[rand.Intn(len(candidates))]
+
+	case ipHash:
+		key := ""
+
+		if ip := clientIP(*r, p.trusted); ip != nil {
+			key = ip.String()
+		}
+
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return candidates[h.Sum32()%uint32(len(candidates))]
+
+	case weighted:
+		return p.weighted(candidates)
+	}
+
+	n := atomic.AddUint64(&p.next, 1)
+	return candidates[(n-1)%uint64(len(candidates))]
+}
+
+// Picks an upstream using smooth weighted round-robin, which spreads the
+// requests sent to heavier upstreams out instead of sending them in bursts.
+func (p *pool) weighted(candidates []*upstream) *upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *upstream
+	bestIndex, total := -1, 0
+
+	for i, u := range p.upstreams {
+		if !contains(candidates, u) {
+			continue
+		}
+
+		p.current[i] += u.weight
+		total += u.weight
+
+		if best == nil || p.current[i] > p.current[bestIndex] {
+			best, bestIndex = u, i
+		}
+	}
+
+	p.current[bestIndex] -= total
+	return best
+}
+
+// Sends a request to the upstream. The upstream's connection stays active
+// until the response body is closed.
+func (u *upstream) roundTrip(transport http.RoundTripper, r *http.Request) (*http.Response, error) {
+	out := new(http.Request)
+	*out = *r
+	out.URL = u.rewrite(r.URL)
+
+	atomic.AddInt64(&u.active, 1)
+	res, err := transport.RoundTrip(out)
+
+	if err != nil {
+		atomic.AddInt64(&u.active, -1)
+		return nil, err
+	}
+
+	done := func() { atomic.AddInt64(&u.active, -1) }
+
+	if rwc, ok := res.Body.(io.ReadWriteCloser); ok {
+		res.Body = &trackedConn{ReadWriteCloser: rwc, done: done}
+	} else {
+		res.Body = &trackedBody{ReadCloser: res.Body, done: done}
+	}
+
+	return res, nil
+}
+
+// Points a request's URL at the upstream, adding the upstream's path and query
+// to the request's.
+func (u *upstream) rewrite(in *url.URL) *url.URL {
+	out := *in
+	out.Scheme = u.url.Scheme
+	out.Host = u.url.Host
+	out.Path = joinURLPath(u.url.Path, in.Path)
+	out.RawPath = ""
+
+	if u.url.RawQuery == "" || in.RawQuery == "" {
+		out.RawQuery = u.url.RawQuery + in.RawQuery
+	} else {
+		out.RawQuery = u.url.RawQuery + "&" + in.RawQuery
+	}
+
+	return &out
+}
+
+// Joins two paths with a single slash, the same way the reverse proxy does.
+func joinURLPath(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+
+	return a + b
+}
+
+// Checks if a request to an upstream failed because of the upstream, either
+// because it could not be reached or because it said it was unavailable.
+func failed(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func contains(upstreams []*upstream, u *upstream) bool {
+	for _, other := range upstreams {
+		if other == u {
+			return true
+		}
+	}
+
+	return false
+}
+
+// trackedBody calls done once the body it wraps is closed.
+type trackedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
+
+// trackedConn is a trackedBody for upgraded connections, like websockets,
+// which the reverse proxy also writes to.
+type trackedConn struct {
+	io.ReadWriteCloser
+	once sync.Once
+	done func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.done)
+	return c.ReadWriteCloser.Close()
+}
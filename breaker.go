@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// fallbackPage is sent instead of proxying requests while the circuit breaker
+// of every upstream of a route is open.
+type fallbackPage struct {
+	body        []byte
+	contentType string
+}
+
+func loadFallbackPage(path string) (*fallbackPage, error) {
+	body, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading fallback page: %v", err)
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+
+	return &fallbackPage{body: body, contentType: contentType}, nil
+}
+
+// Checks if a request can be sent to the upstream. Once the upstream's
+// circuit breaker is open, requests are turned away until the breaker timeout
+// is up. Then a single request is let through, and the breaker is closed
+// again when it succeeds.
+func (u *upstream) allow(opts proxyOptions) bool {
+	if opts.breakerThreshold <= 0 {
+		return true
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.breakerFails < opts.breakerThreshold {
+		return true
+	} else if time.Now().Before(u.breakerOpenUntil) || u.probing {
+		return false
+	}
+
+	info("letting a request through to %v to check if it is back", u.url)
+	u.probing = true
+	return true
+}
+
+// Records the outcome of a request for the upstream's circuit breaker.
+func (u *upstream) trip(ok bool, opts proxyOptions) {
+	if opts.breakerThreshold <= 0 {
+		return
+	}
+
+	wasOpen := u.breakerFails >= opts.breakerThreshold
+	u.probing = false
+
+	if ok {
+		if wasOpen {
+			info("closing circuit breaker of upstream %v", u.url)
+		}
+
+		u.breakerFails = 0
+		return
+	}
+
+	u.breakerFails++
+
+	if u.breakerFails >= opts.breakerThreshold {
+		if !wasOpen {
+			warn("opening circuit breaker of upstream %v for %v after %d failed requests",
+				u.url, opts.breakerTimeout, u.breakerFails)
+		}
+
+		u.breakerOpenUntil = time.Now().Add(opts.breakerTimeout)
+	}
+}
+
+// Lets another request check if the upstream is back when the one that was
+// let through was cancelled before it could tell.
+func (u *upstream) abandon() {
+	u.mu.Lock()
+	u.probing = false
+	u.mu.Unlock()
+}
+
+func (u *upstream) circuit(opts proxyOptions) string {
+	switch {
+	case opts.breakerThreshold <= 0 || u.breakerFails < opts.breakerThreshold:
+		return "closed"
+	case time.Now().Before(u.breakerOpenUntil):
+		return "open"
+	}
+
+	return "half-open"
+}
+
+// Responds to requests that could not be proxied. Requests turned away by
+// circuit breakers get the fallback page, or a plain 503 when there is none.
+func (p *proxyRoute) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if err != errCircuitOpen {
+		proxyErrorHandler(w, r, err)
+		return
+	}
+
+	warn("not proxying request to %v: %v", r.URL, err)
+	w.Header().Set("Retry-After", strconv.Itoa(int(p.opts.breakerTimeout.Seconds())))
+
+	if p.fallback == nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", p.fallback.contentType)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(p.fallback.body)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certManager lets autocert work off of whichever generation is live, so
+// that changes to the `domains` and `cache` definitions take effect on reload
+// rather than requiring a restart.
+type certManager struct {
+	sup *supervisor
+}
+
+// Returns the domains certificates can be issued for. These are the ones
+// given with the -certDomain flag, those in the `domains` definition, and
+// those derived from the servers' host matchers. Host matchers with wildcards
+// are expanded using the apex domains in the `apex` definition.
+func certDomainsFor(env environement, servers []server) []string {
+	var domains []string
+	var apexes []string
+	seen := make(map[string]bool)
+
+	add := func(vals ...string) {
+		for _, val := range vals {
+			if !seen[val] {
+				seen[val] = true
+				domains = append(domains, val)
+			}
+		}
+	}
+
+	add(certDomains...)
+
+	if vals, ok := env.GetValue("domains"); ok {
+		add(vals.Values()...)
+	}
+
+	if vals, ok := env.GetValue("apex"); ok {
+		apexes = vals.Values()
+	}
+
+	for _, server := range servers {
+		if lister, ok := server.Matcher.(hostLister); ok {
+			add(lister.hosts(apexes)...)
+		}
+	}
+
+	return domains
+}
+
+// The -certCache flag takes precedence over the `cache` definition.
+func certCacheFor(env environement) string {
+	if *certCache != "" {
+		return *certCache
+	}
+
+	if cache, ok := env.GetValue("cache"); ok {
+		return cache.Value()
+	}
+
+	return ""
+}
+
+// Logs the domains that were added to or removed from the whitelist between
+// two generations.
+func diffCertDomains(prev, next *generation) {
+	before := make(map[string]bool)
+	after := make(map[string]bool)
+
+	if prev != nil {
+		for _, domain := range prev.domains {
+			before[domain] = true
+		}
+	}
+
+	for _, domain := range next.domains {
+		after[domain] = true
+
+		if !before[domain] {
+			info("whitelisting %s", domain)
+		}
+	}
+
+	for domain := range before {
+		if !after[domain] {
+			info("no longer whitelisting %s", domain)
+		}
+	}
+}
+
+func (m certManager) HostPolicy(ctx context.Context, host string) error {
+	return autocert.HostWhitelist(m.sup.load().domains...)(ctx, host)
+}
+
+func (m certManager) cache() autocert.DirCache {
+	return autocert.DirCache(certCacheFor(m.sup.load().env))
+}
+
+func (m certManager) Get(ctx context.Context, name string) ([]byte, error) {
+	return m.cache().Get(ctx, name)
+}
+
+func (m certManager) Put(ctx context.Context, name string, data []byte) error {
+	return m.cache().Put(ctx, name, data)
+}
+
+func (m certManager) Delete(ctx context.Context, name string) error {
+	return m.cache().Delete(ctx, name)
+}
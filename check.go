@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Check validates a configuration file without starting any servers or
+// creating any handlers, and warns about things that are valid but likely to
+// be mistakes. Returns the exit code serv should exit with.
+func check(fileName string) int {
+	decls, matches, err := readConfig(fileName)
+
+	if err != nil {
+		warn("%v", err)
+		return 1
+	}
+
+	env := newEnvironment(decls)
+	servers, _, errs := compile(env, matches)
+
+	if len(errs) != 0 {
+		warn("%v", reportErrors(fileName, errs))
+		return 1
+	}
+
+	domains := certDomainsFor(env, servers)
+	warnings := checkCertDomains(servers, domains)
+	warnings = append(warnings, checkReachable(servers)...)
+
+	for _, msg := range warnings {
+		warn("%v:%s", fileName, msg)
+	}
+
+	info("%v is valid with %d warning(s)", fileName, len(warnings))
+	return 0
+}
+
+// Looks for cases with host matchers that can match hosts other than the
+// domains a certificate will be issued for. Requests for those hosts fail the
+// TLS handshake before they ever get to the case.
+func checkCertDomains(servers []server, domains []string) []string {
+	var warnings []string
+
+	for _, server := range servers {
+		if covered, ok := coveredBy(server.Matcher, domains); ok && !covered {
+			warnings = append(warnings, fmt.Sprintf("%s: %s can match hosts that no certificate will be issued for",
+				server.expr.val.pos, server))
+		}
+	}
+
+	return warnings
+}
+
+// Looks for cases that can never be reached because a case before them
+// matches every request.
+func checkReachable(servers []server) []string {
+	var warnings []string
+	var catchAll *server
+
+	for i, server := range servers {
+		if catchAll != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %s is unreachable because %s at %s matches every request",
+				server.expr.val.pos, server, *catchAll, catchAll.expr.val.pos))
+		} else if matchesAll(server.Matcher) {
+			catchAll = &servers[i]
+		}
+	}
+
+	return warnings
+}
+
+func matchesAll(m matcher) bool {
+	switch m := m.(type) {
+	case anyMatcher:
+		return true
+
+	case hostMatcher:
+		return m.subdomain.value == "_" && m.domain.value == "_" && m.tld.value == "_"
+
+	case orMatcher:
+		for _, child := range m.matchers {
+			if matchesAll(child) {
+				return true
+			}
+		}
+
+	case andMatcher:
+		for _, child := range m.matchers {
+			if !matchesAll(child) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// Checks if every host a matcher can match is one of the domains. The second
+// value is false when the matcher does not look at the host at all, or only
+// does so through a Not, in which case there is nothing to check. Host
+// patterns with wildcards and host regular expressions match more hosts than
+// any list of domains can cover.
+func coveredBy(m matcher, domains []string) (bool, bool) {
+	switch m := m.(type) {
+	case andMatcher:
+		return coveredByAny(m.matchers, domains)
+
+	case orMatcher:
+		return coveredByAll(m.matchers, domains)
+
+	case hostRegexMatcher:
+		return false, true
+
+	case hostMatcher, hostPatternMatcher:
+		hosts := m.(hostLister).hosts(nil)
+
+		if len(hosts) == 0 {
+			return false, true
+		}
+
+		for _, host := range hosts {
+			if !matchesAnyDomain(m, domains, host) {
+				return false, true
+			}
+		}
+
+		return true, true
+	}
+
+	return false, false
+}
+
+func matchesAnyDomain(m matcher, domains []string, host string) bool {
+	for _, domain := range domains {
+		if hostname(domain) == hostname(host) && m.Match(http.Request{Host: domain}) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func coveredByAll(matchers []matcher, domains []string) (bool, bool) {
+	checked := false
+
+	for _, m := range matchers {
+		if covered, ok := coveredBy(m, domains); ok {
+			checked = true
+
+			if !covered {
+				return false, true
+			}
+		}
+	}
+
+	return checked, checked
+}
+
+func coveredByAny(matchers []matcher, domains []string) (bool, bool) {
+	checked := false
+
+	for _, m := range matchers {
+		if covered, ok := coveredBy(m, domains); ok {
+			checked = true
+
+			if covered {
+				return true, true
+			}
+		}
+	}
+
+	return false, checked
+}
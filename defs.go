@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -13,35 +14,48 @@ type declKind string
 type expr struct {
 	kind exprKind
 	val  token
-	args []token
+	args []expr
 }
 
 type match struct {
-	expr  expr
-	decls []declaration
+	expr      expr
+	decls     []declaration
+	isDefault bool
 }
 
 type declaration struct {
 	kind declKind
 	key  token
+	when *expr
 	val  expr
 }
 
 type token struct {
 	kind   tokenKind
 	lexeme string
+	pos    position
 }
 
 type server struct {
-	Match  func(http.Request) bool
-	Mux    *http.ServeMux
-	routes []route
+	Matcher   matcher
+	Mux       *http.ServeMux
+	expr      expr
+	routes    []route
+	fallback  *route
+	notFound  http.Handler
+	isDefault bool
 }
 
+// Routes for not found pages respond with the same page whatever the
+// request's path is, so they are marked as such.
 type route struct {
-	handler handlerDef
-	path    string
-	data    []string
+	handler      handlerDef
+	path         string
+	data         []string
+	pos          position
+	matcher      matcher
+	notFound     http.Handler
+	notFoundPage bool
 }
 
 const (
@@ -53,6 +67,7 @@ const (
 	closeParToken   tokenKind = "cpartok"   // ")"
 	commaToken      tokenKind = "commatok"  // ","
 	identifierToken tokenKind = "idtok"     // [^\s,()]+
+	stringToken     tokenKind = "strtok"    // "..." | '...' | `...`
 	eofToken        tokenKind = "eoftok"    // EOF
 
 	call exprKind = "call"
@@ -70,12 +85,28 @@ func (m match) String() string {
 		decls = append(decls, fmt.Sprintf("  %s\n", decl))
 	}
 
+	if m.isDefault {
+		return fmt.Sprintf("%s =>\n%s", m.expr, strings.Join(decls, ""))
+	}
+
 	return fmt.Sprintf("case %s =>\n%s", m.expr, strings.Join(decls, ""))
 }
 
+func (s server) String() string {
+	if s.isDefault {
+		return s.expr.String()
+	}
+
+	return fmt.Sprintf("case %s", s.expr)
+}
+
 func (d declaration) String() string {
 	switch d.kind {
 	case path:
+		if d.when != nil {
+			return fmt.Sprintf("path %s when %s %s", d.key.lexeme, d.when, d.val)
+		}
+
 		return fmt.Sprintf("path %s %s", d.key.lexeme, d.val)
 
 	case def:
@@ -92,7 +123,7 @@ func (e expr) String() string {
 		var args []string
 
 		for _, arg := range e.args {
-			args = append(args, fmt.Sprintf("%s", arg.lexeme))
+			args = append(args, arg.String())
 		}
 
 		return fmt.Sprintf("%s(%s)", e.val.lexeme, strings.Join(args, ", "))
@@ -101,19 +132,37 @@ func (e expr) String() string {
 		var items []string
 
 		for _, item := range e.args {
-			items = append(items, fmt.Sprintf("%s", item.lexeme))
+			items = append(items, item.String())
 		}
 
 		return fmt.Sprintf("[%s]", strings.Join(items, " "))
 
 	case exp:
-		return fmt.Sprintf("%s", e.val.lexeme)
+		return e.val.literal()
 
 	default:
 		return "<Invalid Expression>"
 	}
 }
 
+func (t token) String() string {
+	if t.kind == eofToken {
+		return t.lexeme
+	}
+
+	return fmt.Sprintf("`%s`", t.lexeme)
+}
+
+// Returns the token as it would be written in a Servfile. String tokens hold
+// their unescaped value so they are quoted again.
+func (t token) literal() string {
+	if t.kind == stringToken {
+		return strconv.Quote(t.lexeme)
+	}
+
+	return t.lexeme
+}
+
 func (e expr) Value() string {
 	if e.kind == exp {
 		return e.val.lexeme
@@ -127,7 +176,7 @@ func (e expr) Values() []string {
 		var vals []string
 
 		for _, v := range e.args {
-			vals = append(vals, v.lexeme)
+			vals = append(vals, v.val.lexeme)
 		}
 
 		return vals
@@ -7,16 +7,31 @@ package main
  *
  *     MAIN            = declaration* match* EOF ;
  *
- *     match           = "case" expression "=>" declaration* ;
+ *     match           = "case" expression "=>" declaration*
+ *                     | ["default"|"else"] "=>" declaration* ;
  *
- *     declaration     = ["path"|"def"] IDENTIFIER expression ;
+ *     declaration     = "path" IDENTIFIER ["when" call] expression
+ *                     | "def" IDENTIFIER expression ;
  *
- *     expression      = IDENTIFIER
- *                     | "[" IDENTIFIER* "]"
- *                     | IDENTIFIER "(" [IDENTIFIER ["," IDENTIFIER]*] ")" ;
+ *     expression      = VALUE
+ *                     | "[" VALUE* "]"
+ *                     | call ;
+ *
+ *     call            = IDENTIFIER "(" [argument ["," argument]*] ")" ;
+ *
+ *     argument        = VALUE | call ;
+ *
+ *     VALUE           = IDENTIFIER | STRING ;
  *
  *     IDENTIFIER      = [^\s]+
  *
+ *     STRING          = '"' ( [^"\\\n] | ESCAPE )* '"'
+ *                     | "'" ( [^'\\\n] | ESCAPE )* "'"
+ *                     | "`" [^`]* "`" ;
+ *
+ *     ESCAPE          = "\\" ( ["'\\abfnrtv] | "u" HEX{4} | "U" HEX{8}
+ *                     | "x" HEX{2} | OCTAL{3} ) ;
+ *
  *
  * Sample raw input:
  *
@@ -37,10 +52,10 @@ package main
  *         expr: Expr{
  *           kind:  call,
  *           value: Token{kind: identifierToken, lexeme: "Host"},
- *           args: []Token{
- *             Token{kind: identifierToken, lexeme: "_"},
- *             Token{kind: identifierToken, lexeme: "_"},
- *             Token{kind: identifierToken, lexeme: "_"},
+ *           args: []Expr{
+ *             Expr{kind: exp, value: Token{kind: identifierToken, lexeme: "_"}},
+ *             Expr{kind: exp, value: Token{kind: identifierToken, lexeme: "_"}},
+ *             Expr{kind: exp, value: Token{kind: identifierToken, lexeme: "_"}},
  *           },
  *         },
  *         dcls: []Declaration{
@@ -50,8 +65,8 @@ package main
  *             value: Expr{
  *               kind:  call,
  *               value: Token{kind: identifierToken, lexeme: "git"},
- *               args: []Token{
- *                 Token{kind: identifierToken, lexeme: "https://github.com/minond/minond.github.io.git"},
+ *               args: []Expr{
+ *                 Expr{kind: exp, value: Token{kind: identifierToken, lexeme: "https://github.com/minond/minond.github.io.git"}},
  *               },
  *             },
  *           },
@@ -61,8 +76,8 @@ package main
  *             value: Expr{
  *               kind:  call,
  *               value: Token{kind: identifierToken, lexeme: "git"},
- *               args: []Token{
- *                 Token{kind: identifierToken, lexeme: "https://github.com/minond/servies.git"},
+ *               args: []Expr{
+ *                 Expr{kind: exp, value: Token{kind: identifierToken, lexeme: "https://github.com/minond/servies.git"}},
  *               },
  *             },
  *           },
@@ -72,8 +87,8 @@ package main
  *             value: Expr{
  *               kind:  call,
  *               value: Token{kind: identifierToken, lexeme: "dir"},
- *               args: []Token{
- *                 Token{kind: identifierToken, lexeme: "."},
+ *               args: []Expr{
+ *                 Expr{kind: exp, value: Token{kind: identifierToken, lexeme: "."}},
  *               },
  *             },
  *           },
@@ -83,9 +98,9 @@ package main
  *             value: Expr{
  *               kind:  call,
  *               value: Token{kind: identifierToken, lexeme: "cmd"},
- *               args: []Token{
- *                 Token{kind: identifierToken, lexeme: "ps"},
- *                 Token{kind: identifierToken, lexeme: "aux"},
+ *               args: []Expr{
+ *                 Expr{kind: exp, value: Token{kind: identifierToken, lexeme: "ps"}},
+ *                 Expr{kind: exp, value: Token{kind: identifierToken, lexeme: "aux"}},
  *               },
  *             },
  *           },
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type position struct {
+	line   int
+	column int
+	offset int
+}
+
+// parseError is raised by the parser when it comes across a token it was not
+// expecting. It holds enough information to point at the exact location of
+// the problem in the original configuration.
+type parseError struct {
+	expected string
+	found    token
+	snippet  string
+}
+
+// lexError is raised by the tokenizer for malformed input that cannot be
+// turned into a token, like an unterminated string.
+type lexError struct {
+	pos     position
+	message string
+	snippet string
+}
+
+type errorList []error
+
+func (p position) String() string {
+	return fmt.Sprintf("%d:%d", p.line, p.column)
+}
+
+func (e parseError) Error() string {
+	return fmt.Sprintf("%s: expecting %s but found %s instead\n%s",
+		e.found.pos, e.expected, e.found, e.snippet)
+}
+
+func (e lexError) Error() string {
+	return fmt.Sprintf("%s: %s\n%s", e.pos, e.message, e.snippet)
+}
+
+func (l errorList) Error() string {
+	var msgs []string
+
+	for _, err := range l {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+// Builds a two line snippet made up of the line where the error was found and
+// a caret pointing to the column of the offending token.
+func snippet(lines []string, pos position) string {
+	if pos.line < 1 || pos.line > len(lines) {
+		return ""
+	}
+
+	line := strings.TrimRight(lines[pos.line-1], "\r")
+	caret := ""
+
+	for i, r := range []rune(line) {
+		if i >= pos.column-1 {
+			break
+		} else if r == '\t' {
+			caret += "\t"
+		} else {
+			caret += " "
+		}
+	}
+
+	return fmt.Sprintf("    %s\n    %s^", line, caret)
+}
+
+// Appends an error to the list, unless it is nil. Lists are flattened into
+// the list they are appended to.
+func (l errorList) add(err error) errorList {
+	if errs, ok := err.(errorList); ok {
+		return append(l, errs...)
+	} else if err != nil {
+		return append(l, err)
+	}
+
+	return l
+}
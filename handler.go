@@ -1,21 +1,30 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/exec"
 	_path "path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+type contextKey string
+
 const (
 	indexFile = "index.html"
 	rootDir   = "repo"
+
+	capturesKey contextKey = "captures"
 )
 
 var (
@@ -34,16 +43,80 @@ func getRepoPath(repoURL string) (string, error) {
 	return _path.Join(rootDir, ur.Hostname(), ur.EscapedPath()), nil
 }
 
-func pullGitRepoInterval(repoURL string) {
+// pullScheduler makes sure every repository is pulled by a single goroutine
+// no matter how many routes, or generations of routes, serve it.
+type pullScheduler struct {
+	mu    sync.Mutex
+	repos map[string]*pullJob
+}
+
+type pullJob struct {
+	refs   int
+	cancel context.CancelFunc
+}
+
+var pullers = &pullScheduler{repos: make(map[string]*pullJob)}
+
+// Starts pulling a repository, unless it is already being pulled, until the
+// given context is cancelled. The repository stops being pulled once every
+// context that scheduled it is cancelled.
+func (s *pullScheduler) schedule(ctx context.Context, repoURL string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.repos[repoURL]
+
+	if !ok {
+		jobCtx, cancel := context.WithCancel(context.Background())
+		job = &pullJob{cancel: cancel}
+		s.repos[repoURL] = job
+		go pullGitRepoInterval(jobCtx, repoURL)
+	}
+
+	job.refs++
+
+	go func() {
+		<-ctx.Done()
+		s.release(repoURL)
+	}()
+}
+
+func (s *pullScheduler) release(repoURL string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.repos[repoURL]
+
+	if !ok {
+		return
+	}
+
+	job.refs--
+
+	if job.refs <= 0 {
+		job.cancel()
+		delete(s.repos, repoURL)
+	}
+}
+
+func pullGitRepoInterval(ctx context.Context, repoURL string) {
 	info("pulling %v every %v", repoURL, *pullInterval)
+	ticker := time.NewTicker(*pullInterval)
+	defer ticker.Stop()
 
 	for {
-		time.Sleep(*pullInterval)
-		pullGitRepo(repoURL)
+		select {
+		case <-ticker.C:
+			pullGitRepo(ctx, repoURL)
+
+		case <-ctx.Done():
+			info("no longer pulling %v", repoURL)
+			return
+		}
 	}
 }
 
-func pullGitRepo(repoURL string) {
+func pullGitRepo(ctx context.Context, repoURL string) {
 	path, err := getRepoPath(repoURL)
 
 	if found, _ := fileExists(path); !found {
@@ -52,7 +125,7 @@ func pullGitRepo(repoURL string) {
 
 	info("running git pull on %v", path)
 
-	cmd := exec.Command("git", "pull")
+	cmd := exec.CommandContext(ctx, "git", "pull")
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Dir = path
@@ -92,12 +165,14 @@ func localRepoExists(repoURL string) (bool, error) {
 	return fileExists(path)
 }
 
-func assertGitRepo(repoURL string) {
+func assertGitRepo(repoURL string) error {
 	if exists, _ := localRepoExists(repoURL); exists == false {
 		if _, err := checkoutGitRepo(repoURL); err != nil {
-			panic(fmt.Sprintf("error checking out git repo: %v", err))
+			return fmt.Errorf("error checking out git repo: %v", err)
 		}
 	}
+
+	return nil
 }
 
 func fileExists(name string) (bool, error) {
@@ -110,48 +185,51 @@ func fileExists(name string) (bool, error) {
 	return false, nil
 }
 
-func assertDir(name string) {
+func assertDir(name string) error {
 	if exists, _ := fileExists(name); exists == false {
-		panic(fmt.Sprintf("expecting %v directory which does not exists", name))
+		return fmt.Errorf("expecting %v directory which does not exists", name)
 	}
+
+	return nil
 }
 
-func setProxyHandler(mux *http.ServeMux, route route) {
-	proxyURL, err := url.Parse(route.data[0])
-	proxyPath := proxyURL.Path
+// Adds values captured by a matcher to a request's context, along with any
+// values that were already captured for it.
+func withCaptures(r *http.Request, captures map[string]string) *http.Request {
+	prev, _ := r.Context().Value(capturesKey).(map[string]string)
+	merged := make(map[string]string, len(prev)+len(captures))
 
-	if err != nil {
-		panic(fmt.Sprintf("error parting proxy url (%v): %v", route.data[0], err))
+	for name, val := range prev {
+		merged[name] = val
 	}
 
-	proxy := func(w http.ResponseWriter, r *http.Request) {
-		oldPath := r.URL.Path
-		newPath := strings.Replace(oldPath, route.path, "", 1)
-
-		r.URL.Path = proxyPath + newPath
+	for name, val := range captures {
+		merged[name] = val
+	}
 
-		info("making request to %v", r.URL)
-		handler := httputil.NewSingleHostReverseProxy(proxyURL)
+	return r.WithContext(context.WithValue(r.Context(), capturesKey, merged))
+}
 
-		if r.Header.Get("Upgrade") == "websocket" {
-			info("proxying websocket connection to %s", r.URL.Path)
-		} else {
-			r.Header.Add("X-Forwarded-Proto", "https")
-			r.Header.Add("X-Forwarded-Ssl", "on")
-			r.Header.Add("X-Forwarded-Port", "443")
-		}
+// Replaces every `{name}` in a handler argument with the value captured under
+// that name for the request. Names that were not captured are left as-is.
+func expand(arg string, r *http.Request) string {
+	captures, _ := r.Context().Value(capturesKey).(map[string]string)
 
-		handler.ServeHTTP(w, r)
+	for name, val := range captures {
+		arg = strings.Replace(arg, "{"+name+"}", val, -1)
 	}
 
-	mux.HandleFunc(route.path, proxy)
-	mux.HandleFunc(route.path+"/", proxy)
+	return arg
+}
+
+func templated(arg string) bool {
+	return strings.Contains(arg, "{") && strings.Contains(arg, "}")
 }
 
 func setCmdHandler(mux *http.ServeMux, route route) {
 	mux.HandleFunc(route.path, func(w http.ResponseWriter, r *http.Request) {
 		parts := route.data
-		cmd := exec.Command(parts[0], parts[1:]...)
+		cmd := exec.CommandContext(r.Context(), parts[0], parts[1:]...)
 		info("executing `%v` command", parts)
 
 		cmd.Stdout = w
@@ -162,21 +240,77 @@ func setCmdHandler(mux *http.ServeMux, route route) {
 	})
 }
 
+// Parses the status code and optional body of a status route.
+func parseStatusRoute(route route) (int, string, error) {
+	code, err := strconv.Atoi(route.data[0])
+
+	if err != nil || http.StatusText(code) == "" {
+		return 0, "", fmt.Errorf("invalid status code: %v", route.data[0])
+	}
+
+	body := http.StatusText(code)
+
+	if len(route.data) > 1 {
+		body = route.data[1]
+	}
+
+	return code, body, nil
+}
+
+func setStatusHandler(mux *http.ServeMux, route route) error {
+	code, body, err := parseStatusRoute(route)
+
+	if err != nil {
+		return err
+	}
+
+	mux.HandleFunc(route.path, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, body, code)
+	})
+
+	return nil
+}
+
 func setRedirectHandler(mux *http.ServeMux, route route) {
 	mux.HandleFunc(route.path, func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, route.data[0], http.StatusSeeOther)
+		http.Redirect(w, r, expand(route.data[0], r), http.StatusSeeOther)
 	})
 }
 
 func setDirHandler(mux *http.ServeMux, route route) {
 	serveFile := func(w http.ResponseWriter, r *http.Request) {
 		filePath := strings.Replace(r.URL.Path, route.path, "", 1)
+		dir := expand(route.data[0], r)
+		local404Path := _path.Join(dir, "404.html")
+
+		// Not found pages are the directory's 404.html, or its index.html
+		// when there is no 404.html.
+		if route.notFoundPage {
+			filePath = indexFile
+
+			if exists, _ := fileExists(local404Path); exists == true {
+				filePath = "404.html"
+			}
+		}
 
 		if filePath == "" {
 			filePath = indexFile
 		}
 
-		loc := guessFileInDir(filePath, route.data[0])
+		loc, found := guessFileInDir(filePath, dir)
+
+		if !found {
+			info("could not find %v in %v", r.URL.String(), dir)
+
+			if exists, _ := fileExists(local404Path); exists == true {
+				http.ServeFile(&statusWriter{ResponseWriter: w, status: http.StatusNotFound}, r, local404Path)
+			} else {
+				route.notFound.ServeHTTP(w, r)
+			}
+
+			return
+		}
+
 		info("serving %v from %v", r.URL.String(), loc)
 		http.ServeFile(w, r, loc)
 	}
@@ -205,21 +339,66 @@ func setGitHandler(mux *http.ServeMux, route route) {
 	setDirHandler(mux, route)
 }
 
-// NOTE This does have an issue in that if no local 404 file is found we should
-// fallback to /404.html, but we don't since this function (or the handler)
-// doesn't know about other routes and which one is on the / endpoint.
-func guessFileInDir(file, dir string) string {
+// Looks for a file in a directory, trying it with an .html extension first.
+// When neither is found it is up to the caller to handle the request as not
+// found.
+func guessFileInDir(file, dir string) (string, bool) {
 	origPath := _path.Join(dir, file)
 	htmlPath := origPath + ".html"
-	local404Path := _path.Join(dir, "404.html")
 
 	if exists, _ := fileExists(htmlPath); exists == true {
-		return htmlPath
+		return htmlPath, true
 	} else if exists, _ := fileExists(origPath); exists == true {
-		return origPath
-	} else if exists, _ := fileExists(local404Path); exists == true {
-		return local404Path
+		return origPath, true
 	}
 
-	return origPath
+	return origPath, false
+}
+
+// statusWriter replaces the status of successful responses with its own. It
+// lets any handler be used to respond to requests that were not found.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status == http.StatusOK {
+		status = w.status
+	}
+
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+
+	return nil, nil, errors.New("response writer does not support hijacking")
+}
+
+// Unwrap lets http.ResponseController get to the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// poolRegistry keeps track of the pools of every proxy route that is live so
+// their state can be reported.
+type poolRegistry struct {
+	mu    sync.Mutex
+	pools map[*pool]bool
+}
+
+type poolStatus struct {
+	Path      string           `json:"path"`
+	Policy    string           `json:"policy"`
+	Upstreams []upstreamStatus `json:"upstreams"`
+}
+
+type upstreamStatus struct {
+	URL          string     `json:"url"`
+	Healthy      bool       `json:"healthy"`
+	Ejected      bool       `json:"ejected"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	Fails        int        `json:"fails"`
+	Active       int64      `json:"active"`
+	Circuit      string     `json:"circuit"`
+}
+
+var registry = &poolRegistry{pools: make(map[*pool]bool)}
+
+// Adds a pool to the registry until the pool is stopped.
+func (reg *poolRegistry) add(p *pool) {
+	reg.mu.Lock()
+	reg.pools[p] = true
+	reg.mu.Unlock()
+
+	go func() {
+		<-p.ctx.Done()
+		reg.mu.Lock()
+		delete(reg.pools, p)
+		reg.mu.Unlock()
+	}()
+}
+
+func (reg *poolRegistry) status() []poolStatus {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	statuses := []poolStatus{}
+
+	for p := range reg.pools {
+		statuses = append(statuses, p.status())
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Path < statuses[j].Path
+	})
+
+	return statuses
+}
+
+func (p *pool) status() poolStatus {
+	now := time.Now()
+	status := poolStatus{Path: p.path, Policy: p.opts.policy}
+
+	for _, u := range p.upstreams {
+		u.mu.Lock()
+		s := upstreamStatus{
+			URL:     u.url.String(),
+			Healthy: !u.down,
+			Ejected: now.Before(u.ejectedUntil),
+			Fails:   u.fails,
+			Active:  atomic.LoadInt64(&u.active),
+			Circuit: u.circuit(p.opts),
+		}
+
+		if s.Ejected {
+			until := u.ejectedUntil
+			s.EjectedUntil = &until
+		}
+
+		u.mu.Unlock()
+		status.Upstreams = append(status.Upstreams, s)
+	}
+
+	return status
+}
+
+// Checks the health of every upstream in the pool on an interval until the
+// pool is stopped.
+func (p *pool) check() {
+	ticker := time.NewTicker(p.opts.healthInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, u := range p.upstreams {
+			go u.check(p.ctx, p.transport, p.opts)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// Requests the upstream's health check path. The upstream is healthy when it
+// responds with the expected status, or with any 2xx status when no status is
+// expected.
+func (u *upstream) check(ctx context.Context, transport http.RoundTripper, opts proxyOptions) {
+	ctx, cancel := context.WithTimeout(ctx, opts.healthTimeout)
+	defer cancel()
+
+	target := *u.url
+	target.Path = joinURLPath(u.url.Path, opts.healthPath)
+	target.RawQuery = ""
+
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+
+	if err != nil {
+		u.setDown(true, err.Error())
+		return
+	}
+
+	res, err := transport.RoundTrip(req.WithContext(ctx))
+
+	if err != nil {
+		if ctx.Err() != context.Canceled {
+			u.setDown(true, err.Error())
+		}
+
+		return
+	}
+
+	res.Body.Close()
+
+	if opts.healthStatus != 0 && res.StatusCode != opts.healthStatus {
+		u.setDown(true, fmt.Sprintf("expecting status %d but got %d", opts.healthStatus, res.StatusCode))
+	} else if opts.healthStatus == 0 && (res.StatusCode < 200 || res.StatusCode > 299) {
+		u.setDown(true, fmt.Sprintf("got status %d", res.StatusCode))
+	} else {
+		u.setDown(false, "")
+	}
+}
+
+func (u *upstream) setDown(down bool, reason string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if down && !u.down {
+		warn("upstream %v failed its health check: %v", u.url, reason)
+	} else if !down && u.down {
+		info("upstream %v passed its health check", u.url)
+		u.fails = 0
+		u.ejectedUntil = time.Time{}
+	}
+
+	u.down = down
+}
+
+// Records the outcome of a request sent to the upstream. The upstream is
+// taken out of rotation for the fail timeout after max fails requests in a
+// row fail, after which it is tried again. The outcome is recorded for the
+// upstream's circuit breaker too.
+func (u *upstream) report(ok bool, opts proxyOptions) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.trip(ok, opts)
+
+	if opts.maxFails <= 0 {
+		return
+	} else if ok {
+		if u.fails >= opts.maxFails {
+			info("upstream %v is back in rotation", u.url)
+		}
+
+		u.fails = 0
+		return
+	}
+
+	u.fails++
+
+	if u.fails == opts.maxFails || u.fails > opts.maxFails && !time.Now().Before(u.ejectedUntil) {
+		warn("upstream %v failed %d requests in a row, taking it out of rotation for %v",
+			u.url, u.fails, opts.failTimeout)
+		u.ejectedUntil = time.Now().Add(opts.failTimeout)
+	}
+}
+
+func (u *upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return !u.down && !now.Before(u.ejectedUntil)
+}
+
+// Responds with the state of the upstreams of every proxy route as JSON.
+func setUpstreamsHandler(mux *http.ServeMux, route route) {
+	mux.HandleFunc(route.path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		if err := enc.Encode(registry.status()); err != nil {
+			warn("error writing upstreams status: %v", err)
+		}
+	})
+}
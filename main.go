@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/acme/autocert"
@@ -14,6 +20,12 @@ import (
 
 type stringListFlag []string
 
+const defaultShutdownTimeout = 30 * time.Second
+
+// How long to wait for handlers to return once whatever they are running has
+// been cancelled, like commands being killed.
+const cancelTimeout = 5 * time.Second
+
 var (
 	certDomains stringListFlag
 	certCache   = flag.String("certCache", "", "Path to Let's Encrypt cache file. Use this along with the cache definition.")
@@ -32,125 +44,209 @@ func (l *stringListFlag) Set(val string) error {
 
 func init() {
 	flag.Var(&certDomains, "certDomain", "Domain(s) whitelist. Use this along with the domains definition.")
-	flag.Parse()
 }
 
 func main() {
+	flag.Parse()
+
+	if flag.Arg(0) == "check" {
+		os.Exit(check(*config))
+	}
+
 	ch := make(chan bool)
+	ctx, stop := context.WithCancel(context.Background())
+	sup := &supervisor{ctx: ctx}
 
-	setupHandler()
-	go setupListener()
+	if err := setupHandler(sup); err != nil {
+		fatal("%v", err)
+	}
+
+	servers := setupListener(ctx, sup)
 	go watch(*config, ch)
 
 	info("watching %v for changes", *config)
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+
 	for {
-		<-ch
-		info("reacting to changes in %v", *config)
-		setupHandler()
-		info("applied updates to %v", *config)
-	}
-}
+		select {
+		case <-ch:
+			info("reacting to changes in %v", *config)
 
-func watch(fileName string, ch chan bool) {
-	curr, err := os.Stat(fileName)
+		case <-hup:
+			info("received SIGHUP, reloading %v", *config)
 
-	if err != nil {
-		warn("error getting stats for %v: %v", *config, err)
-		return
-	}
+		case sig := <-term:
+			info("received %v, shutting down", sig)
+			shutdown(sup, servers, stop)
+			return
+		}
 
-	for {
-		next, err := os.Stat(fileName)
-
-		if err != nil {
-			warn("error getting stats for %v: %v", *config, err)
-		} else if next.ModTime() != curr.ModTime() {
-			curr = next
-			ch <- true
-			time.Sleep(time.Second * 15)
+		if err := setupHandler(sup); err != nil {
+			warn("%v, keeping previous configuration", err)
 		} else {
-			time.Sleep(time.Second * 60)
+			info("applied updates to %v", *config)
 		}
 	}
 }
 
-func setupHandler() {
-	info("reading configuration from %v", *config)
-	contents, err := ioutil.ReadFile(*config)
+// Reads and parses the configuration file. Every syntax error found is logged
+// along with its location before an error is returned.
+func readConfig(fileName string) ([]declaration, []match, error) {
+	info("reading configuration from %v", fileName)
+	contents, err := ioutil.ReadFile(fileName)
 
 	if err != nil {
-		warn("error reading Servfile: %v", err)
-		return
+		return nil, nil, fmt.Errorf("error reading Servfile: %v", err)
 	}
 
-	decls, matches := parse(string(contents))
-	servers, _ := runtime(decls, matches)
+	decls, matches, errs := parse(string(contents))
 
-	supervisor := http.NewServeMux()
-	http.DefaultServeMux = supervisor
-
-	supervisor.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		handled := false
+	if len(errs) != 0 {
+		return nil, nil, reportErrors(fileName, errs)
+	}
 
-		for i, server := range servers {
-			info("comparing request to server #%d", i+1)
+	return decls, matches, nil
+}
 
-			if server.Match(*r) {
-				server.Mux.ServeHTTP(w, r)
-				handled = true
-				break
-			}
-		}
+func reportErrors(fileName string, errs []error) error {
+	for _, err := range errs {
+		warn("%v:%v", fileName, err)
+	}
 
-		if !handled {
-			warn("no matches found")
-		}
-	})
+	return fmt.Errorf("found %d error(s) in %v", len(errs), fileName)
 }
 
-func setupListener() {
-	info("reading configuration from %v", *config)
-	contents, err := ioutil.ReadFile(*config)
+// Builds a new generation from the configuration file. The new generation is
+// only put in place once every server and route in it was successfully
+// created, otherwise the one that is already live is left alone.
+func setupHandler(sup *supervisor) error {
+	decls, matches, err := readConfig(*config)
 
 	if err != nil {
-		fatal("Error reading Servfile: %v", err)
+		return err
 	}
 
-	decls, matches := parse(string(contents))
-	_, env := runtime(decls, matches)
+	gen, err := runtime(sup.ctx, decls, matches)
 
-	if cache, ok := env.GetValue("cache"); ok && *certCache == "" {
-		*certCache = cache.Value()
+	if errs, ok := err.(errorList); ok {
+		return reportErrors(*config, errs)
+	} else if err != nil {
+		return err
 	}
 
-	if domains, ok := env.GetValue("domains"); ok {
-		certDomains = append(certDomains, domains.Values()...)
-	}
+	gen.domains = certDomainsFor(gen.env, gen.servers)
+	prev := sup.swap(gen)
+	info("generation #%d is now live", gen.id)
 
 	if *listen == "" {
-		for _, domain := range certDomains {
-			info("whitelisting %s", domain)
-		}
+		diffCertDomains(prev, gen)
+	}
+
+	return nil
+}
 
+// Starts the HTTP and HTTPS servers in the background and returns them so
+// they can be shut down later. Every request's context is derived from the
+// given context.
+func setupListener(ctx context.Context, sup *supervisor) []*http.Server {
+	baseContext := func(net.Listener) context.Context {
+		return ctx
+	}
+
+	if *listen == "" {
+		certs := certManager{sup: sup}
 		m := &autocert.Manager{
-			Cache:      autocert.DirCache(*certCache),
+			Cache:      certs,
 			Prompt:     autocert.AcceptTOS,
-			HostPolicy: autocert.HostWhitelist(certDomains...),
+			HostPolicy: certs.HostPolicy,
 		}
 
-		go func() {
-			fatal("%s", http.ListenAndServe(":http", m.HTTPHandler(nil)))
-		}()
+		h := &http.Server{
+			Addr:        ":http",
+			Handler:     m.HTTPHandler(nil),
+			BaseContext: baseContext,
+		}
 
 		s := &http.Server{
-			Addr:      ":https",
-			TLSConfig: &tls.Config{GetCertificate: m.GetCertificate},
+			Addr:        ":https",
+			Handler:     sup,
+			BaseContext: baseContext,
+			TLSConfig:   &tls.Config{GetCertificate: m.GetCertificate},
 		}
 
-		fatal("%s", s.ListenAndServeTLS("", ""))
-	} else {
-		info("starting http server on %v", *listen)
-		fatal("%s", http.ListenAndServe(*listen, nil))
+		go serve(h.ListenAndServe)
+		go serve(func() error { return s.ListenAndServeTLS("", "") })
+		return []*http.Server{h, s}
+	}
+
+	info("starting http server on %v", *listen)
+
+	s := &http.Server{
+		Addr:        *listen,
+		Handler:     sup,
+		BaseContext: baseContext,
+	}
+
+	go serve(s.ListenAndServe)
+	return []*http.Server{s}
+}
+
+func serve(listen func() error) {
+	if err := listen(); err != http.ErrServerClosed {
+		fatal("%s", err)
+	}
+}
+
+// Stops accepting new connections and waits for the requests that are in
+// flight to finish, for up to the configured shutdown timeout. Anything still
+// running after that, like proxied websockets and commands, is cancelled, and
+// serv waits for it to stop so no commands are left running after it exits.
+func shutdown(sup *supervisor, servers []*http.Server, stop context.CancelFunc) {
+	gen := sup.load()
+	timeout, _ := gen.env.GetDuration("shutdown_timeout", defaultShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	info("waiting up to %v for connections to drain", timeout)
+	gen.cancel()
+
+	var wg sync.WaitGroup
+
+	for _, s := range servers {
+		wg.Add(1)
+
+		go func(s *http.Server) {
+			defer wg.Done()
+
+			if err := s.Shutdown(ctx); err != nil {
+				warn("error shutting down server on %v: %v", s.Addr, err)
+			}
+		}(s)
+	}
+
+	wg.Wait()
+
+	if err := sup.drain(ctx); err != nil {
+		warn("gave up waiting for active requests: %v", err)
 	}
+
+	stop()
+
+	for _, s := range servers {
+		s.Close()
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+
+	if err := sup.drain(ctx); err != nil {
+		warn("gave up waiting for cancelled requests: %v", err)
+	}
+
+	info("shutdown complete")
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// anyMatcher matches every request. It is what the default block uses.
+type anyMatcher struct{}
+
+// methodMatcher matches requests made with any of its methods.
+type methodMatcher struct {
+	methods []string
+}
+
+// attrMatcher matches requests with a header, query parameter, or cookie set
+// to a value. A value of `_` matches any value as long as the attribute is
+// there.
+type attrMatcher struct {
+	name  string
+	value string
+	get   func(r http.Request, name string) (string, bool)
+}
+
+// andMatcher matches when every one of its matchers does.
+type andMatcher struct {
+	matchers []matcher
+}
+
+// orMatcher matches when any one of its matchers does.
+type orMatcher struct {
+	matchers []matcher
+}
+
+// notMatcher matches when its matcher does not.
+type notMatcher struct {
+	matcher matcher
+}
+
+func newMethodMatcher(args ...string) (matcher, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("expecting at least one method")
+	}
+
+	var methods []string
+
+	for _, arg := range args {
+		methods = append(methods, strings.ToUpper(arg))
+	}
+
+	return methodMatcher{methods: methods}, nil
+}
+
+func newAttrMatcher(get func(http.Request, string) (string, bool)) func(...string) (matcher, error) {
+	return func(args ...string) (matcher, error) {
+		return attrMatcher{
+			name:  args[0],
+			value: args[1],
+			get:   get,
+		}, nil
+	}
+}
+
+func getHeader(r http.Request, name string) (string, bool) {
+	vals, ok := r.Header[http.CanonicalHeaderKey(name)]
+
+	if !ok || len(vals) == 0 {
+		return "", false
+	}
+
+	return vals[0], true
+}
+
+func getQuery(r http.Request, name string) (string, bool) {
+	if r.URL == nil {
+		return "", false
+	}
+
+	vals, ok := r.URL.Query()[name]
+
+	if !ok || len(vals) == 0 {
+		return "", false
+	}
+
+	return vals[0], true
+}
+
+func getCookie(r http.Request, name string) (string, bool) {
+	cookie, err := r.Cookie(name)
+
+	if err != nil {
+		return "", false
+	}
+
+	return cookie.Value, true
+}
+
+func newAndMatcher(matchers ...matcher) (matcher, error) {
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("expecting at least one matcher")
+	}
+
+	return andMatcher{matchers: matchers}, nil
+}
+
+func newOrMatcher(matchers ...matcher) (matcher, error) {
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("expecting at least one matcher")
+	}
+
+	return orMatcher{matchers: matchers}, nil
+}
+
+func newNotMatcher(matchers ...matcher) (matcher, error) {
+	return notMatcher{matcher: matchers[0]}, nil
+}
+
+func (a anyMatcher) Match(r http.Request) bool {
+	return true
+}
+
+func (m methodMatcher) Match(r http.Request) bool {
+	for _, method := range m.methods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a attrMatcher) Match(r http.Request) bool {
+	val, ok := a.get(r, a.name)
+
+	if !ok {
+		return false
+	}
+
+	return a.value == "_" || a.value == val
+}
+
+func (a andMatcher) Match(r http.Request) bool {
+	for _, m := range a.matchers {
+		if !m.Match(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (a andMatcher) captures(r http.Request) map[string]string {
+	vals := make(map[string]string)
+
+	for _, m := range a.matchers {
+		if c, ok := m.(capturer); ok {
+			for name, val := range c.captures(r) {
+				vals[name] = val
+			}
+		}
+	}
+
+	return vals
+}
+
+// Only hosts that every host matcher agrees on are listed.
+func (a andMatcher) hosts(apexes []string) []string {
+	var hosts []string
+
+	for _, m := range a.matchers {
+		lister, ok := m.(hostLister)
+
+		if !ok {
+			continue
+		}
+
+		for _, host := range lister.hosts(apexes) {
+			if matchesHost(a.matchers, host) {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+
+	return hosts
+}
+
+func (o orMatcher) Match(r http.Request) bool {
+	for _, m := range o.matchers {
+		if m.Match(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (o orMatcher) captures(r http.Request) map[string]string {
+	for _, m := range o.matchers {
+		if !m.Match(r) {
+			continue
+		}
+
+		if c, ok := m.(capturer); ok {
+			return c.captures(r)
+		}
+
+		break
+	}
+
+	return map[string]string{}
+}
+
+func (o orMatcher) hosts(apexes []string) []string {
+	var hosts []string
+
+	for _, m := range o.matchers {
+		if lister, ok := m.(hostLister); ok {
+			hosts = append(hosts, lister.hosts(apexes)...)
+		}
+	}
+
+	return hosts
+}
+
+func (n notMatcher) Match(r http.Request) bool {
+	return !n.matcher.Match(r)
+}
+
+// Checks a host against the matchers that only look at the host.
+func matchesHost(matchers []matcher, host string) bool {
+	for _, m := range matchers {
+		if _, ok := m.(hostLister); ok && !m.Match(http.Request{Host: host}) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -2,67 +2,116 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
 type parser struct {
 	pos    int
 	tokens []token
+	lines  []string
 }
 
-var eof = tok(eofToken, "<eof>")
-
 // Parse takes the string configuration, parses it, and returns a slice
-// of declarations and matchers.
-func parse(raw string) ([]declaration, []match) {
+// of declarations and matchers. Parsing does not stop at the first syntax
+// error, every problem found is returned in the error slice.
+func parse(raw string) ([]declaration, []match, []error) {
+	processed := preprocessor(raw)
+	tokens, errs := tokenize(processed)
 	p := parser{
 		pos:    0,
-		tokens: tokenize(preprocessor(raw)),
+		tokens: tokens,
+		lines:  strings.Split(processed, "\n"),
 	}
 
 	var decls []declaration
 	var matches []match
 
 	for !p.done() {
-		if p.peek().lexeme == "case" {
-			matches = append(matches, p.match())
-		} else {
-			decls = append(decls, p.declaration())
+		start := p.pos
+		err := p.try(func() {
+			if p.block() {
+				matches = append(matches, p.match(&errs))
+			} else {
+				decls = append(decls, p.declaration())
+			}
+		})
+
+		if err != nil {
+			errs = append(errs, err)
+			p.synchronize(start, "case", "default", "else", "path", "def")
 		}
 	}
 
-	return decls, matches
+	return decls, matches, errs
 }
 
-func (p *parser) match() match {
-	if p.eat().lexeme != "case" {
-		panic(fmt.Sprintf("Expecting `case` but found %s instead.",
-			p.prev().lexeme))
+// Handles "case" expression "=>" declaration* as well as default blocks,
+// which have no expression: ["default"|"else"] "=>" declaration*
+func (p *parser) match(errs *[]error) match {
+	mat := match{}
+
+	switch p.peek().lexeme {
+	case "case":
+		p.eat()
+
+	case "default", "else":
+		mat.isDefault = true
+		mat.expr = valueExpr(p.eat())
+
+	default:
+		p.fail("`case` or `default`")
 	}
 
-	mat := match{}
-	mat.expr = p.expression()
+	start := p.pos
+	err := p.try(func() {
+		if !mat.isDefault {
+			mat.expr = p.expression()
+		}
+
+		if !p.matches(blockOpenToken) {
+			p.fail("`=>`")
+		}
+	})
 
-	if !p.matches(blockOpenToken) {
-		panic(fmt.Sprintf("Expecting `=>` but found %s instead.",
-			p.peek().lexeme))
+	if err != nil {
+		*errs = append(*errs, err)
+		p.synchronize(start, "=>", "case", "default", "else")
+
+		if !p.matches(blockOpenToken) {
+			return mat
+		}
 	}
 
-	for !p.done() {
-		mat.decls = append(mat.decls, p.declaration())
+	for !p.done() && !p.block() {
+		start := p.pos
+		err := p.try(func() {
+			mat.decls = append(mat.decls, p.declaration())
+		})
 
-		if p.peek().lexeme == "case" {
-			break
+		if err != nil {
+			*errs = append(*errs, err)
+			p.synchronize(start, "case", "default", "else", "path", "def")
 		}
 	}
 
 	return mat
 }
 
+// Checks if the parser is at the start of a case or default block.
+func (p parser) block() bool {
+	switch p.peek().lexeme {
+	case "case", "default", "else":
+		return p.check(identifierToken)
+	}
+
+	return false
+}
+
 func (p *parser) declaration() declaration {
 	decl := declaration{}
 
-	switch p.eat().lexeme {
+	switch p.peek().lexeme {
 	case "path":
 		decl.kind = path
 
@@ -70,15 +119,22 @@ func (p *parser) declaration() declaration {
 		decl.kind = def
 
 	default:
-		panic(fmt.Sprintf("Invalid declaration type: %s",
-			p.prev().lexeme))
+		p.fail("a declaration (`path` or `def`)")
 	}
 
+	p.eat()
+
 	if p.matches(identifierToken) {
 		decl.key = p.prev()
 	} else {
-		panic(fmt.Sprintf("Expecting an identifier but found %s instead",
-			p.peek().kind))
+		p.fail("an identifier")
+	}
+
+	// Handles the optional "when" call of a path declaration.
+	if decl.kind == path && p.peek().lexeme == "when" && p.check(identifierToken) {
+		p.eat()
+		when := p.expression()
+		decl.when = &when
 	}
 
 	decl.val = p.expression()
@@ -86,49 +142,115 @@ func (p *parser) declaration() declaration {
 }
 
 func (p *parser) expression() expr {
-	expr := expr{kind: exp}
+	e := expr{kind: exp}
 
-	// Handles "[" IDENTIFIER* "]"
+	// Handles "[" VALUE* "]"
 	if p.matches(openSqrToken) {
-		var items []token
-		expr.kind = list
+		var items []expr
+		e.kind = list
 
 		for !p.matches(closeSqrToken) {
-			items = append(items, p.eat())
-			expr.args = items
+			if !p.check(identifierToken, stringToken) {
+				p.fail("a value or `]`")
+			}
+
+			items = append(items, valueExpr(p.eat()))
+			e.args = items
 		}
 	} else {
-		// Handles IDENTIFIER
-		//       | IDENTIFIER "(" [IDENTIFIER ["," IDENTIFIER]*] ")" ;
-		expr.val = p.eat()
+		// Handles VALUE
+		//       | IDENTIFIER "(" [argument ["," argument]*] ")" ;
+		if !p.check(identifierToken, stringToken) {
+			p.fail("an expression")
+		}
 
-		if p.matches(openParToken) {
-			var args []token
-			expr.kind = call
+		e.val = p.eat()
+
+		if e.val.kind == identifierToken && p.matches(openParToken) {
+			var args []expr
+			e.kind = call
 
 		arg:
 			if p.matches(closeParToken) {
-				return expr
+				return e
 			}
 
-			if p.matches(identifierToken) {
-				args = append(args, p.prev())
-				expr.args = args
+			// Arguments are expressions too, which lets calls be nested.
+			if p.check(identifierToken, stringToken) {
+				args = append(args, p.expression())
+				e.args = args
 			} else {
-				panic(fmt.Sprintf("Expecting an identifier but found %s",
-					p.peek().kind))
+				p.fail("a value or a call")
 			}
 
 			if p.matches(commaToken) {
 				goto arg
 			} else if !p.matches(closeParToken) {
-				panic(fmt.Sprintf("Expecting a closing paren but found %s",
-					p.peek().kind))
+				p.fail("`,` or `)`")
 			}
 		}
 	}
 
-	return expr
+	return e
+}
+
+// Runs a parsing function and turns any parse error raised while running it
+// into a returned error. Anything other than a parse error is re-raised.
+func (p *parser) try(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			perr, ok := r.(parseError)
+
+			if !ok {
+				panic(r)
+			}
+
+			err = perr
+		}
+	}()
+
+	fn()
+	return nil
+}
+
+// Skips over tokens until one of the given lexemes is found, which is where
+// the parser can safely resume after an error. At least one token is always
+// consumed when the parser has not moved since start so that it never gets
+// stuck on the same token.
+func (p *parser) synchronize(start int, lexemes ...string) {
+	if p.pos == start {
+		p.eat()
+	}
+
+	for !p.done() {
+		for _, lexeme := range lexemes {
+			if p.peek().lexeme == lexeme {
+				return
+			}
+		}
+
+		p.eat()
+	}
+}
+
+func (p parser) fail(expected string) {
+	found := p.peek()
+
+	panic(parseError{
+		expected: expected,
+		found:    found,
+		snippet:  snippet(p.lines, found.pos),
+	})
+}
+
+func (p parser) check(kinds ...tokenKind) bool {
+	for _, kind := range kinds {
+		if p.peek().kind == kind {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (p *parser) matches(kinds ...tokenKind) bool {
@@ -144,7 +266,7 @@ func (p *parser) matches(kinds ...tokenKind) bool {
 
 func (p *parser) eat() token {
 	if p.done() {
-		return eof
+		return p.peek()
 	}
 
 	tok := p.peek()
@@ -157,8 +279,8 @@ func (p parser) prev() token {
 }
 
 func (p parser) peek() token {
-	if p.done() {
-		return eof
+	if p.pos >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
 	}
 
 	return p.tokens[p.pos]
@@ -171,7 +293,8 @@ func (p parser) done() bool {
 
 // In charge of prepping raw text for the tokenizer. Right now this just means
 // removing comments but if we wanted to add macros, they could be handled
-// here.
+// here. Comment lines are blanked out rather than removed so that token
+// positions still point to the right line in the original file.
 func preprocessor(raw string) string {
 	var processed []string
 
@@ -185,6 +308,7 @@ func preprocessor(raw string) string {
 
 	for _, line := range strings.Split(raw, "\n") {
 		if startsWith("#", line) {
+			processed = append(processed, "")
 			continue
 		}
 
@@ -194,53 +318,141 @@ func preprocessor(raw string) string {
 	return strings.Join(processed, "\n")
 }
 
-func tokenize(raw string) []token {
+func tokenize(raw string) ([]token, []error) {
 	var tokens []token
+	var errs []error
+	lines := strings.Split(raw, "\n")
 	letters := []rune(raw)
 	pos := 0
+	line := 1
+	lineStart := 0
+
+	at := func(offset int) position {
+		return position{
+			line:   line,
+			column: offset - lineStart + 1,
+			offset: offset,
+		}
+	}
+
+	emit := func(kind tokenKind, lexeme string) {
+		tokens = append(tokens, tok(kind, lexeme, at(pos)))
+	}
 
 	identifier := func() {
 		w := word(pos, letters)
-		pos += len(w) - 1
-		tokens = append(tokens, tok(identifierToken, w))
+		emit(identifierToken, w)
+		pos += len([]rune(w)) - 1
+	}
+
+	fail := func(offset int, tmpl string, parts ...interface{}) {
+		errs = append(errs, lexError{
+			pos:     at(offset),
+			message: fmt.Sprintf(tmpl, parts...),
+			snippet: snippet(lines, at(offset)),
+		})
+	}
+
+	// Handles "..." and '...' strings, which may not span multiple lines and
+	// support the same escape sequences as Go string literals.
+	quotedString := func() {
+		quote := letters[pos]
+		start := at(pos)
+		end := pos + 1
+
+		for ; end < len(letters); end++ {
+			if letters[end] == quote || letters[end] == '\n' {
+				break
+			} else if letters[end] == '\\' && next(end, letters) != '\n' {
+				end++
+			}
+		}
+
+		if end >= len(letters) {
+			end = len(letters)
+		}
+
+		value, err := unescape(string(letters[pos+1:end]), byte(quote))
+
+		if end == len(letters) || letters[end] != quote {
+			fail(pos, "unterminated string")
+			end--
+		} else if err != nil {
+			fail(pos, "invalid escape sequence in %s", string(letters[pos:end+1]))
+		}
+
+		tokens = append(tokens, tok(stringToken, value, start))
+		pos = end
+	}
+
+	// Handles `...` strings, which are taken as-is and may span multiple lines.
+	rawString := func() {
+		start := at(pos)
+		end := pos + 1
+
+		for ; end < len(letters) && letters[end] != '`'; end++ {
+			if letters[end] == '\n' {
+				line++
+				lineStart = end + 1
+			}
+		}
+
+		if end >= len(letters) {
+			fail(start.offset, "unterminated raw string")
+			end = len(letters)
+		}
+
+		tokens = append(tokens, tok(stringToken, string(letters[pos+1:end]), start))
+		pos = end
 	}
 
 	for ; pos < len(letters); pos++ {
 		switch letters[pos] {
 		case rune(','):
-			tokens = append(tokens, tok(commaToken, ","))
+			emit(commaToken, ",")
 
 		case rune('['):
-			tokens = append(tokens, tok(openSqrToken, "["))
+			emit(openSqrToken, "[")
 
 		case rune(']'):
-			tokens = append(tokens, tok(closeSqrToken, "]"))
+			emit(closeSqrToken, "]")
 
 		case rune('('):
-			tokens = append(tokens, tok(openParToken, "("))
+			emit(openParToken, "(")
 
 		case rune(')'):
-			tokens = append(tokens, tok(closeParToken, ")"))
+			emit(closeParToken, ")")
 
 		case rune(':'):
-			if next(pos, letters).lexeme == "=" {
-				tokens = append(tokens, tok(defEqToken, ":="))
+			if next(pos, letters) == '=' {
+				emit(defEqToken, ":=")
 				pos++
 			} else {
 				identifier()
 			}
 
 		case rune('='):
-			if next(pos, letters).lexeme == ">" {
-				tokens = append(tokens, tok(blockOpenToken, "=>"))
+			if next(pos, letters) == '>' {
+				emit(blockOpenToken, "=>")
 				pos++
 			} else {
 				identifier()
 			}
 
+		case rune('"'):
+			fallthrough
+		case rune('\''):
+			quotedString()
+
+		case rune('`'):
+			rawString()
+
+		case rune('\n'):
+			line++
+			lineStart = pos + 1
+
 		case rune(' '):
 		case rune('\t'):
-		case rune('\n'):
 		case rune('\r'):
 
 		default:
@@ -248,19 +460,49 @@ func tokenize(raw string) []token {
 		}
 	}
 
-	return tokens
+	return append(tokens, tok(eofToken, "<eof>", at(pos))), errs
+}
+
+// Replaces escape sequences in the body of a quoted string with the
+// characters they represent. Both \" and \' are allowed in either kind of
+// quoted string.
+func unescape(body string, quote byte) (string, error) {
+	var buff strings.Builder
+
+	for len(body) > 0 {
+		if strings.HasPrefix(body, `\"`) || strings.HasPrefix(body, `\'`) {
+			buff.WriteByte(body[1])
+			body = body[2:]
+			continue
+		}
+
+		r, _, tail, err := strconv.UnquoteChar(body, quote)
+
+		if err != nil {
+			return body, err
+		}
+
+		buff.WriteRune(r)
+		body = tail
+	}
+
+	return buff.String(), nil
+}
+
+func tok(kind tokenKind, lexeme string, pos position) token {
+	return token{kind, lexeme, pos}
 }
 
-func tok(kind tokenKind, lexeme string) token {
-	return token{kind, lexeme}
+func valueExpr(val token) expr {
+	return expr{kind: exp, val: val}
 }
 
-func next(pos int, letters []rune) token {
-	if pos+1 > len(letters) {
-		return eof
+func next(pos int, letters []rune) rune {
+	if pos+1 >= len(letters) {
+		return 0
 	}
 
-	return tok(identifierToken, string(letters[pos+1]))
+	return letters[pos+1]
 }
 
 func word(pos int, letters []rune) string {
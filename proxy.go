@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Routes with templated URLs keep at most this many reverse proxies around.
+const maxProxiesPerRoute = 256
+
+// proxyOptions tune the connections a proxy route makes to its upstreams and
+// how it picks between them. They are set with `key=value` arguments after the
+// upstreams' URLs, like
+// `proxy(http://localhost:3000, response_timeout=10s, max_idle_per_host=32)`.
+type proxyOptions struct {
+	dialTimeout      time.Duration
+	keepAlive        time.Duration
+	tlsTimeout       time.Duration
+	responseTimeout  time.Duration
+	idleTimeout      time.Duration
+	maxIdle          int
+	maxIdlePerHost   int
+	maxConnsPerHost  int
+	flushInterval    time.Duration
+	skipVerify       bool
+	policy           string
+	weights          []int
+	healthPath       string
+	healthInterval   time.Duration
+	healthTimeout    time.Duration
+	healthStatus     int
+	maxFails         int
+	failTimeout      time.Duration
+	retries          int
+	retryBackoff     time.Duration
+	retryErrors      bool
+	retryStatuses    map[int]bool
+	retryBodyLimit   int64
+	breakerThreshold int
+	breakerTimeout   time.Duration
+	fallback         string
+}
+
+// proxyRoute is the handler of a proxy route. Every route has a transport of
+// its own, shared by the pools of every upstream the route sends requests to.
+// Routes with templated URLs have a pool per set of URLs they expand to.
+type proxyRoute struct {
+	ctx       context.Context
+	route     route
+	targets   []string
+	opts      proxyOptions
+	transport *http.Transport
+	trusted   []*net.IPNet
+
+	fallback *fallbackPage
+
+	mu    sync.Mutex
+	pools map[string]*pool
+}
+
+func defaultProxyOptions() proxyOptions {
+	return proxyOptions{
+		dialTimeout:    30 * time.Second,
+		keepAlive:      30 * time.Second,
+		tlsTimeout:     10 * time.Second,
+		idleTimeout:    90 * time.Second,
+		maxIdle:        100,
+		maxIdlePerHost: 16,
+		policy:         roundRobin,
+		healthInterval: 10 * time.Second,
+		healthTimeout:  5 * time.Second,
+		maxFails:       3,
+		failTimeout:    30 * time.Second,
+		retryBackoff:   100 * time.Millisecond,
+		retryErrors:    true,
+		retryStatuses: map[int]bool{
+			http.StatusBadGateway:         true,
+			http.StatusServiceUnavailable: true,
+			http.StatusGatewayTimeout:     true,
+		},
+		retryBodyLimit: 64 << 10,
+		breakerTimeout: 30 * time.Second,
+	}
+}
+
+// Parses the `key=value` arguments of a proxy route.
+func parseProxyOptions(args []string) (proxyOptions, error) {
+	opts := defaultProxyOptions()
+	policySet := false
+
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+
+		if len(parts) != 2 {
+			return opts, fmt.Errorf("expecting a key=value option but found %v", arg)
+		}
+
+		var err error
+		key, val := parts[0], parts[1]
+		policySet = policySet || key == "policy"
+
+		switch key {
+		case "dial_timeout":
+			opts.dialTimeout, err = time.ParseDuration(val)
+
+		case "keepalive":
+			opts.keepAlive, err = time.ParseDuration(val)
+
+		case "tls_timeout":
+			opts.tlsTimeout, err = time.ParseDuration(val)
+
+		case "response_timeout":
+			opts.responseTimeout, err = time.ParseDuration(val)
+
+		case "idle_timeout":
+			opts.idleTimeout, err = time.ParseDuration(val)
+
+		case "flush_interval":
+			opts.flushInterval, err = time.ParseDuration(val)
+
+		case "max_idle":
+			opts.maxIdle, err = strconv.Atoi(val)
+
+		case "max_idle_per_host":
+			opts.maxIdlePerHost, err = strconv.Atoi(val)
+
+		case "max_conns_per_host":
+			opts.maxConnsPerHost, err = strconv.Atoi(val)
+
+		case "tls_skip_verify":
+			opts.skipVerify, err = strconv.ParseBool(val)
+
+		case "policy":
+			switch val {
+			case roundRobin, leastConns, randomPick, ipHash, weighted:
+				opts.policy = val
+			default:
+				err = fmt.Errorf("unknown policy")
+			}
+
+		case "health_path":
+			opts.healthPath = val
+
+		case "health_interval":
+			opts.healthInterval, err = time.ParseDuration(val)
+
+			if err == nil && opts.healthInterval <= 0 {
+				err = fmt.Errorf("interval must be positive")
+			}
+
+		case "health_timeout":
+			opts.healthTimeout, err = time.ParseDuration(val)
+
+		case "health_status":
+			opts.healthStatus, err = strconv.Atoi(val)
+
+			if err == nil && http.StatusText(opts.healthStatus) == "" {
+				err = fmt.Errorf("unknown status")
+			}
+
+		case "max_fails":
+			opts.maxFails, err = strconv.Atoi(val)
+
+		case "fail_timeout":
+			opts.failTimeout, err = time.ParseDuration(val)
+
+		case "retries":
+			opts.retries, err = strconv.Atoi(val)
+
+		case "retry_backoff":
+			opts.retryBackoff, err = time.ParseDuration(val)
+
+		case "retry_on":
+			opts.retryErrors, opts.retryStatuses, err = parseRetryOn(val)
+
+		case "retry_body_limit":
+			opts.retryBodyLimit, err = strconv.ParseInt(val, 10, 64)
+
+		case "breaker_threshold":
+			opts.breakerThreshold, err = strconv.Atoi(val)
+
+		case "breaker_timeout":
+			opts.breakerTimeout, err = time.ParseDuration(val)
+
+		case "fallback":
+			opts.fallback = val
+
+		case "weights":
+			opts.weights, err = parseWeights(val)
+
+			if !policySet {
+				opts.policy = weighted
+			}
+
+		default:
+			return opts, fmt.Errorf("unknown proxy option: %v", key)
+		}
+
+		if err != nil {
+			return opts, fmt.Errorf("invalid value for proxy option %v: %v", key, val)
+		}
+	}
+
+	return opts, nil
+}
+
+// Parses weights separated by colons, like `3:1:1`.
+func parseWeights(val string) ([]int, error) {
+	var weights []int
+
+	for _, part := range strings.Split(val, ":") {
+		weight, err := strconv.Atoi(part)
+
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid weight")
+		}
+
+		weights = append(weights, weight)
+	}
+
+	return weights, nil
+}
+
+func newProxyTransport(opts proxyOptions) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   opts.dialTimeout,
+		KeepAlive: opts.keepAlive,
+	}
+
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   opts.tlsTimeout,
+		ResponseHeaderTimeout: opts.responseTimeout,
+		IdleConnTimeout:       opts.idleTimeout,
+		MaxIdleConns:          opts.maxIdle,
+		MaxIdleConnsPerHost:   opts.maxIdlePerHost,
+		MaxConnsPerHost:       opts.maxConnsPerHost,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: opts.skipVerify},
+	}
+}
+
+// Parses and checks the arguments of a proxy route: its upstreams' URLs, its
+// options, and its fallback page. Nothing is created so it can be used to
+// validate a route.
+func parseProxyRoute(route route) ([]string, proxyOptions, *fallbackPage, error) {
+	var fallback *fallbackPage
+
+	targets, args := splitProxyArgs(route.data)
+	opts, err := parseProxyOptions(args)
+
+	if err != nil {
+		return nil, opts, nil, err
+	} else if len(targets) == 0 {
+		return nil, opts, nil, fmt.Errorf("expecting at least one upstream url")
+	} else if len(opts.weights) != 0 && len(opts.weights) != len(targets) {
+		return nil, opts, nil, fmt.Errorf("expecting %d weights but got %d", len(targets), len(opts.weights))
+	}
+
+	for _, target := range targets {
+		if templated(target) {
+			continue
+		} else if _, err := parseUpstreamURL(target); err != nil {
+			return nil, opts, nil, err
+		}
+	}
+
+	if opts.fallback != "" {
+		if fallback, err = loadFallbackPage(opts.fallback); err != nil {
+			return nil, opts, nil, err
+		}
+	}
+
+	return targets, opts, fallback, nil
+}
+
+func setProxyHandler(ctx context.Context, mux *http.ServeMux, route route, trusted []*net.IPNet) error {
+	targets, opts, fallback, err := parseProxyRoute(route)
+
+	if err != nil {
+		return err
+	}
+
+	p := &proxyRoute{
+		ctx:       ctx,
+		route:     route,
+		targets:   targets,
+		opts:      opts,
+		transport: newProxyTransport(opts),
+		trusted:   trusted,
+		fallback:  fallback,
+		pools:     make(map[string]*pool),
+	}
+
+	if !templated(strings.Join(targets, " ")) {
+		if _, err := p.proxy(targets); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		p.transport.CloseIdleConnections()
+	}()
+
+	mux.Handle(route.path, p)
+	mux.Handle(route.path+"/", p)
+	return nil
+}
+
+// Splits the arguments of a proxy route into its upstreams' URLs and its
+// `key=value` options.
+func splitProxyArgs(args []string) ([]string, []string) {
+	var targets []string
+	var opts []string
+
+	for _, arg := range args {
+		if strings.Contains(arg, "://") {
+			targets = append(targets, arg)
+		} else {
+			opts = append(opts, arg)
+		}
+	}
+
+	return targets, opts
+}
+
+// Returns the reverse proxy for a set of upstreams, creating it the first
+// time the upstreams are used.
+func (p *proxyRoute) proxy(targets []string) (*httputil.ReverseProxy, error) {
+	key := strings.Join(targets, " ")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if upstreams, ok := p.pools[key]; ok {
+		return upstreams.proxy, nil
+	}
+
+	upstreams, err := newPool(p.ctx, p.route.path, targets, p.opts, p.transport, p.trusted)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.pools) >= maxProxiesPerRoute {
+		for _, old := range p.pools {
+			old.stop()
+		}
+
+		p.pools = make(map[string]*pool)
+	}
+
+	upstreams.proxy = &httputil.ReverseProxy{
+		Director:      keepUserAgent,
+		Transport:     upstreams,
+		FlushInterval: p.opts.flushInterval,
+		ErrorHandler:  p.errorHandler,
+	}
+
+	p.pools[key] = upstreams
+	return upstreams.proxy, nil
+}
+
+// Keeps the transport from adding its own user agent to requests that did not
+// have one.
+func keepUserAgent(r *http.Request) {
+	if _, ok := r.Header["User-Agent"]; !ok {
+		r.Header.Set("User-Agent", "")
+	}
+}
+
+func (p *proxyRoute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var targets []string
+
+	for _, target := range p.targets {
+		targets = append(targets, expand(target, r))
+	}
+
+	proxy, err := p.proxy(targets)
+
+	if err != nil {
+		proxyErrorHandler(w, r, err)
+		return
+	}
+
+	// The pool adds the path of the upstream's URL itself.
+	r.URL.Path = strings.TrimPrefix(r.URL.Path, p.route.path)
+	r.URL.RawPath = ""
+
+	if r.Header.Get("Upgrade") == "websocket" {
+		info("proxying websocket connection to %s", r.URL.Path)
+	} else {
+		info("making request to %v", r.URL)
+	}
+
+	setForwardedHeaders(r, p.trusted)
+	proxy.ServeHTTP(w, r)
+}
+
+// Sets the headers that tell an upstream about the client and the original
+// request: Forwarded, X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host,
+// X-Forwarded-Port, X-Forwarded-Ssl, and X-Real-IP. The values sent by the
+// peer are only kept when it is a trusted proxy, in which case this hop is
+// added to them. Otherwise they are replaced with values taken from the
+// connection the request came in on.
+func setForwardedHeaders(r *http.Request, trusted []*net.IPNet) {
+	peer := peerIP(*r)
+	proto, host, port := requestOrigin(r)
+
+	hop := []string{"proto=" + proto, "host=" + forwardedValue(host)}
+
+	if peer != nil {
+		hop = append([]string{"for=" + forwardedValue(forwardedNode(peer))}, hop...)
+	}
+
+	if peer != nil && containsIP(trusted, peer) {
+		proto = headerOr(r, "X-Forwarded-Proto", proto)
+		host = headerOr(r, "X-Forwarded-Host", host)
+		port = headerOr(r, "X-Forwarded-Port", port)
+
+		// The X-Forwarded-For header is added to by the reverse proxy.
+		r.Header.Set("Forwarded", strings.Join(append(r.Header["Forwarded"], strings.Join(hop, ";")), ", "))
+	} else {
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Set("Forwarded", strings.Join(hop, ";"))
+	}
+
+	r.Header.Set("X-Forwarded-Proto", proto)
+	r.Header.Set("X-Forwarded-Host", host)
+	r.Header.Set("X-Forwarded-Port", port)
+
+	if proto == "https" {
+		r.Header.Set("X-Forwarded-Ssl", "on")
+	} else {
+		r.Header.Set("X-Forwarded-Ssl", "off")
+	}
+
+	if ip := clientIP(*r, trusted); ip != nil {
+		r.Header.Set("X-Real-IP", ip.String())
+	} else {
+		r.Header.Del("X-Real-IP")
+	}
+}
+
+// Returns the scheme, host, and port a request was made to, as seen by serv.
+// The port is the one of the listener the request came in on.
+func requestOrigin(r *http.Request) (string, string, string) {
+	proto, port := "http", "80"
+
+	if r.TLS != nil {
+		proto, port = "https", "443"
+	}
+
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, p, err := net.SplitHostPort(addr.String()); err == nil {
+			port = p
+		}
+	} else if _, p, err := net.SplitHostPort(r.Host); err == nil {
+		port = p
+	}
+
+	return proto, r.Host, port
+}
+
+func headerOr(r *http.Request, name, fallback string) string {
+	if val := r.Header.Get(name); val != "" {
+		return val
+	}
+
+	return fallback
+}
+
+// Formats an address as a node of a Forwarded header, where IPv6 addresses
+// are wrapped in brackets.
+func forwardedNode(ip net.IP) string {
+	if ip.To4() == nil {
+		return "[" + ip.String() + "]"
+	}
+
+	return ip.String()
+}
+
+// Quotes a value of a Forwarded header when it has characters that are not
+// allowed in a token, like the colons in ports and IPv6 addresses.
+func forwardedValue(val string) string {
+	for _, c := range val {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return strconv.Quote(val)
+		}
+	}
+
+	return val
+}
+
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	warn("error proxying request to %v: %v", r.URL, err)
+	http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// remoteAddrMatcher matches requests coming from a client in any of its
+// networks. The client's address is only taken from the X-Forwarded-For and
+// X-Real-IP headers when the request came through a trusted proxy.
+type remoteAddrMatcher struct {
+	nets    []*net.IPNet
+	trusted []*net.IPNet
+}
+
+func newRemoteAddrMatcher(trusted []*net.IPNet, args ...string) (matcher, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("expecting at least one network")
+	}
+
+	nets, err := parseCIDRs(args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return remoteAddrMatcher{nets: nets, trusted: trusted}, nil
+}
+
+func (m remoteAddrMatcher) Match(r http.Request) bool {
+	ip := clientIP(r, m.trusted)
+	return ip != nil && containsIP(m.nets, ip)
+}
+
+// Parses a list of networks in CIDR notation. Plain addresses are treated as
+// networks made up of just that address.
+func parseCIDRs(vals []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, val := range vals {
+		if !strings.Contains(val, "/") {
+			ip := net.ParseIP(val)
+
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %v", val)
+			}
+
+			bits := 8 * net.IPv6len
+
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(val)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %v", val)
+		}
+
+		nets = append(nets, ipnet)
+	}
+
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the address of the peer a request came from directly.
+func peerIP(r http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// Returns the address of the client that made a request. When the request
+// came from a trusted proxy, the X-Forwarded-For header is walked from the
+// right, skipping over other trusted proxies, and the first address that is
+// not trusted is the client. X-Real-IP is used when there is no
+// X-Forwarded-For header.
+func clientIP(r http.Request, trusted []*net.IPNet) net.IP {
+	ip := peerIP(r)
+
+	if ip == nil || !containsIP(trusted, ip) {
+		return ip
+	}
+
+	var hops []string
+
+	for _, header := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	if len(hops) == 0 {
+		if real := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); real != nil {
+			return real
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+
+		if hop == nil {
+			break
+		}
+
+		ip = hop
+
+		if !containsIP(trusted, hop) {
+			break
+		}
+	}
+
+	return ip
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Requests are only retried when their method is idempotent.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// Reads the body of a request that may be retried into memory so that it can
+// be sent more than once. Bodies larger than the retry body limit are left as
+// they are and the request is sent only once. Requests without a body can
+// always be sent again, but that only means they can be sent to another
+// upstream when one cannot be connected to. They are still only retried when
+// their method is idempotent.
+func (p *pool) buffer(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	} else if p.opts.retries == 0 || !idempotentMethods[r.Method] ||
+		r.ContentLength > p.opts.retryBodyLimit {
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, p.opts.retryBodyLimit+1))
+
+	if err != nil || int64(len(body)) > p.opts.retryBodyLimit {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+
+	r.Body.Close()
+	return body, true
+}
+
+// Checks if a failed request should be retried, which depends on the
+// request's method and on what went wrong.
+func (p *pool) retryable(r *http.Request, res *http.Response, err error) bool {
+	if !idempotentMethods[r.Method] {
+		return false
+	} else if err != nil {
+		return p.opts.retryErrors
+	}
+
+	return p.opts.retryStatuses[res.StatusCode]
+}
+
+// Waits before a retry, twice as long as before every time.
+func backoff(ctx context.Context, base time.Duration, attempt int) error {
+	timer := time.NewTimer(base << uint(attempt-1))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Parses the errors and statuses requests are retried on, separated by colons,
+// like `error:502:503`.
+func parseRetryOn(val string) (bool, map[int]bool, error) {
+	onErrors := false
+	statuses := make(map[int]bool)
+
+	for _, part := range strings.Split(val, ":") {
+		if part == "error" {
+			onErrors = true
+			continue
+		}
+
+		status, err := strconv.Atoi(part)
+
+		if err != nil || http.StatusText(status) == "" {
+			return false, nil, fmt.Errorf("expecting `error` or a status but found %v", part)
+		}
+
+		statuses[status] = true
+	}
+
+	return onErrors, statuses, nil
+}
+
+func describe(res *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+
+	return res.Status
+}
+
+// readCloser reads from one reader and closes another.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"net/http"
+	_path "path"
+	"regexp"
 	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
 )
 
 type environement struct {
@@ -15,38 +23,107 @@ type runtimeValue struct {
 	value string
 }
 
+// Matchers with a variadic arity check their own arguments.
+const variadic = -1
+
+// Handlers are validated when a configuration is compiled, which is also
+// done by `serv check`, so validation must not have side effects. The
+// constructor only runs when a configuration is put in place.
 type handlerDef struct {
 	arity       int
-	constructor func(route, *http.ServeMux)
+	validate    func(route) error
+	constructor func(context.Context, route, *http.ServeMux) error
 }
 
+// Matchers are either made from plain values or, for combinators, from the
+// matchers their arguments are turned into.
 type matcherDef struct {
 	arity       int
-	constructor func(...string) matcher
+	constructor func(...string) (matcher, error)
+	combinator  func(...matcher) (matcher, error)
 }
 
 type matcher interface {
 	Match(http.Request) bool
 }
 
+// hostLister is implemented by matchers that know which hosts they match, so
+// that certificates can be requested for them. Matchers with wildcards can
+// only list the hosts they match under the given apex domains.
+type hostLister interface {
+	hosts(apexes []string) []string
+}
+
+// capturer is implemented by matchers that extract values from the request,
+// which are then available to the handlers as `{name}` in their arguments.
+type capturer interface {
+	captures(http.Request) map[string]string
+}
+
 type nullMatcher struct{}
 
+// hostMatcher matches a host split into its subdomain, domain, and top-level
+// domain. The top-level domain is the host's public suffix, so `co.uk` is a
+// single tld and the subdomain is whatever labels are left, however many
+// there are.
 type hostMatcher struct {
 	subdomain runtimeValue
 	domain    runtimeValue
 	tld       runtimeValue
 }
 
+// hostPatternMatcher matches a whole host against a single pattern, like
+// `*.minond.xyz` or `api-*.example.com`.
+type hostPatternMatcher struct {
+	pattern runtimeValue
+}
+
+// hostRegexMatcher matches a host against a regular expression. Named
+// capture groups in the expression are captured.
+type hostRegexMatcher struct {
+	re *regexp.Regexp
+}
+
 func value(val string) runtimeValue {
-	return runtimeValue{value: val}
+	return runtimeValue{value: strings.ToLower(val)}
 }
 
+// Values can be `_`, which matches anything including nothing at all, or a
+// glob pattern. Globs are matched one label at a time so a `*` never matches
+// across a dot.
 func (v runtimeValue) equals(other string) bool {
 	if v.value == "_" {
 		return true
+	} else if other == "" {
+		return v.value == ""
 	}
 
-	return v.value == other
+	patterns := strings.Split(v.value, ".")
+	labels := strings.Split(other, ".")
+
+	if len(patterns) != len(labels) {
+		return false
+	}
+
+	for i := range patterns {
+		if ok, _ := _path.Match(patterns[i], labels[i]); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (v runtimeValue) concrete() bool {
+	return v.value != "_" && !strings.ContainsAny(v.value, "*?[\\")
+}
+
+func (v runtimeValue) validate() error {
+	if _, err := _path.Match(v.value, ""); err != nil {
+		return fmt.Errorf("invalid pattern %s: %v", v.value, err)
+	}
+
+	return nil
 }
 
 func (n nullMatcher) Match(r http.Request) bool {
@@ -54,90 +131,373 @@ func (n nullMatcher) Match(r http.Request) bool {
 }
 
 func (h hostMatcher) Match(r http.Request) bool {
-	parts := strings.Split(r.Host, ".")
-	subdomain := ""
-	domain := ""
-	tld := ""
+	subdomain, domain, tld := splitHost(r.Host)
 
-	switch len(parts) {
-	case 1:
-		domain = parts[0]
+	return h.subdomain.equals(subdomain) &&
+		h.domain.equals(domain) &&
+		h.tld.equals(tld)
+}
 
-	case 2:
-		domain = parts[0]
-		tld = parts[1]
+func (h hostMatcher) hosts(apexes []string) []string {
+	var hosts []string
 
-	case 3:
-		subdomain = parts[0]
-		domain = parts[1]
-		tld = parts[2]
+	if h.subdomain.concrete() && h.domain.concrete() && h.tld.concrete() {
+		return []string{joinLabels(h.subdomain.value, h.domain.value, h.tld.value)}
 	}
 
-	return h.subdomain.equals(subdomain) &&
-		h.domain.equals(domain) &&
-		h.tld.equals(tld)
+	for _, apex := range apexes {
+		host := apex
+
+		if h.subdomain.concrete() {
+			host = joinLabels(h.subdomain.value, apex)
+		} else if h.subdomain.value != "_" {
+			continue
+		}
+
+		if h.Match(http.Request{Host: host}) {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hosts
+}
+
+func (h hostPatternMatcher) Match(r http.Request) bool {
+	return h.pattern.equals(hostname(r.Host))
+}
+
+func (h hostPatternMatcher) hosts(apexes []string) []string {
+	var hosts []string
+
+	if h.pattern.concrete() {
+		return []string{h.pattern.value}
+	}
+
+	for _, apex := range apexes {
+		if h.pattern.equals(apex) {
+			hosts = append(hosts, apex)
+		}
+	}
+
+	return hosts
+}
+
+func (h hostRegexMatcher) Match(r http.Request) bool {
+	return h.re.MatchString(hostname(r.Host))
+}
+
+// Captured values end up in file paths and urls so anything that could be
+// used to get out of a directory is left out.
+func (h hostRegexMatcher) captures(r http.Request) map[string]string {
+	vals := make(map[string]string)
+	groups := h.re.FindStringSubmatch(hostname(r.Host))
+
+	for i, name := range h.re.SubexpNames() {
+		if i == 0 || name == "" || i >= len(groups) {
+			continue
+		} else if strings.Contains(groups[i], "..") || strings.ContainsAny(groups[i], "/\\") {
+			continue
+		}
+
+		vals[name] = groups[i]
+	}
+
+	return vals
+}
+
+// Strips the port and any trailing dot from a request's host.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.Trim(host, "[]")
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Splits a host into its subdomain, domain, and public suffix. Hosts without
+// a dot and IP addresses are all domain.
+func splitHost(host string) (string, string, string) {
+	host = hostname(host)
+
+	if !strings.Contains(host, ".") || net.ParseIP(host) != nil {
+		return "", host, ""
+	}
+
+	tld, _ := publicsuffix.PublicSuffix(host)
+
+	if tld == host {
+		return "", "", tld
+	}
+
+	rest := strings.TrimSuffix(host, "."+tld)
+	i := strings.LastIndex(rest, ".")
+
+	if i == -1 {
+		return "", rest, tld
+	}
+
+	return rest[:i], rest[i+1:], tld
+}
+
+func joinLabels(labels ...string) string {
+	var parts []string
+
+	for _, label := range labels {
+		if label != "" {
+			parts = append(parts, label)
+		}
+	}
+
+	return strings.Join(parts, ".")
+}
+
+func newHostMatcher(args ...string) (matcher, error) {
+	var vals []runtimeValue
+
+	for _, arg := range args {
+		val := value(arg)
+
+		if err := val.validate(); err != nil {
+			return nil, err
+		}
+
+		vals = append(vals, val)
+	}
+
+	switch len(vals) {
+	case 1:
+		return hostPatternMatcher{pattern: vals[0]}, nil
+
+	case 3:
+		return hostMatcher{
+			subdomain: vals[0],
+			domain:    vals[1],
+			tld:       vals[2],
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("expecting 1 or 3 arguments but got %d", len(vals))
+	}
 }
 
 func newEnvironment(decls []declaration) environement {
-	return environement{
-		declarations: decls,
-		matchers: map[string]matcherDef{
-			"Host": {
-				arity: 3,
-				constructor: func(args ...string) matcher {
-					return hostMatcher{
-						subdomain: value(args[0]),
-						domain:    value(args[1]),
-						tld:       value(args[2]),
-					}
-				},
+	env := environement{declarations: decls}
+	trusted, _ := env.GetNetworks("trusted_proxies")
+
+	env.matchers = map[string]matcherDef{
+		"Host": {
+			arity:       variadic,
+			constructor: newHostMatcher,
+		},
+		"Method": {
+			arity:       variadic,
+			constructor: newMethodMatcher,
+		},
+		"Header": {
+			arity:       2,
+			constructor: newAttrMatcher(getHeader),
+		},
+		"Query": {
+			arity:       2,
+			constructor: newAttrMatcher(getQuery),
+		},
+		"Cookie": {
+			arity:       2,
+			constructor: newAttrMatcher(getCookie),
+		},
+		"And": {
+			arity:      variadic,
+			combinator: newAndMatcher,
+		},
+		"Or": {
+			arity:      variadic,
+			combinator: newOrMatcher,
+		},
+		"Not": {
+			arity:      1,
+			combinator: newNotMatcher,
+		},
+		"RemoteAddr": {
+			arity: variadic,
+			constructor: func(args ...string) (matcher, error) {
+				return newRemoteAddrMatcher(trusted, args...)
+			},
+		},
+		"Weight": {
+			arity: variadic,
+			constructor: func(args ...string) (matcher, error) {
+				return newWeightMatcher(trusted, args...)
+			},
+		},
+		"Between": {
+			arity:       2,
+			constructor: newBetweenMatcher,
+		},
+		"Cron": {
+			arity:       variadic,
+			constructor: newCronMatcher,
+		},
+		"HostRegex": {
+			arity: 1,
+			constructor: func(args ...string) (matcher, error) {
+				re, err := regexp.Compile(args[0])
+
+				if err != nil {
+					return nil, err
+				}
+
+				return hostRegexMatcher{re: re}, nil
+			},
+		},
+	}
+
+	env.handlers = map[string]handlerDef{
+		"git": {
+			arity: 1,
+			validate: func(route route) error {
+				_, err := getRepoPath(route.data[0])
+				return err
+			},
+			constructor: func(ctx context.Context, route route, mux *http.ServeMux) error {
+				if err := assertGitRepo(route.data[0]); err != nil {
+					return err
+				}
+
+				setGitHandler(mux, route)
+				pullers.schedule(ctx, route.data[0])
+				return nil
 			},
 		},
+		"dir": {
+			arity: 1,
+			validate: func(route route) error {
+				if templated(route.data[0]) {
+					info("not checking %v since it depends on the request", route.data[0])
+					return nil
+				}
 
-		handlers: map[string]handlerDef{
-			"git": {
-				arity: 1,
-				constructor: func(route route, mux *http.ServeMux) {
-					assertGitRepo(route.data[0])
-					setGitHandler(mux, route)
-					go pullGitRepoInterval(route.data[0])
-				},
+				return assertDir(route.data[0])
+			},
+			constructor: func(ctx context.Context, route route, mux *http.ServeMux) error {
+				setDirHandler(mux, route)
+				return nil
+			},
+		},
+		"status": {
+			arity: 1,
+			validate: func(route route) error {
+				_, _, err := parseStatusRoute(route)
+				return err
 			},
-			"dir": {
-				arity: 1,
-				constructor: func(route route, mux *http.ServeMux) {
-					assertDir(route.data[0])
-					setDirHandler(mux, route)
-				},
+			constructor: func(ctx context.Context, route route, mux *http.ServeMux) error {
+				return setStatusHandler(mux, route)
 			},
-			"redirect": {
-				arity: 1,
-				constructor: func(route route, mux *http.ServeMux) {
-					setRedirectHandler(mux, route)
-				},
+		},
+		"redirect": {
+			arity: 1,
+			constructor: func(ctx context.Context, route route, mux *http.ServeMux) error {
+				setRedirectHandler(mux, route)
+				return nil
 			},
-			"cmd": {
-				arity: 1,
-				constructor: func(route route, mux *http.ServeMux) {
-					setCmdHandler(mux, route)
-				},
+		},
+		"cmd": {
+			arity: 1,
+			constructor: func(ctx context.Context, route route, mux *http.ServeMux) error {
+				setCmdHandler(mux, route)
+				return nil
 			},
-			"proxy": {
-				arity: 1,
-				constructor: func(route route, mux *http.ServeMux) {
-					setProxyHandler(mux, route)
-				},
+		},
+		"proxy": {
+			arity: 1,
+			validate: func(route route) error {
+				_, _, _, err := parseProxyRoute(route)
+				return err
+			},
+			constructor: func(ctx context.Context, route route, mux *http.ServeMux) error {
+				return setProxyHandler(ctx, mux, route, trusted)
+			},
+		},
+		"upstreams": {
+			arity: 0,
+			constructor: func(ctx context.Context, route route, mux *http.ServeMux) error {
+				setUpstreamsHandler(mux, route)
+				return nil
 			},
 		},
 	}
+
+	return env
+}
+
+// Parses a definition as a duration, like `def shutdown_timeout 30s`. The
+// fallback value is returned when the definition is missing.
+func (env environement) GetDuration(name string, fallback time.Duration) (time.Duration, error) {
+	decl, ok := env.GetDeclaration(name)
+
+	if !ok {
+		return fallback, nil
+	}
+
+	dur, err := time.ParseDuration(decl.val.Value())
+
+	if err != nil {
+		return fallback, fmt.Errorf("%s: invalid duration for %s: %s",
+			decl.key.pos, name, decl.val)
+	}
+
+	return dur, nil
+}
+
+// Parses a definition as a list of networks, like
+// `def trusted_proxies [ 10.0.0.0/8 127.0.0.1 ]`. Errors point at the item
+// that could not be parsed.
+func (env environement) GetNetworks(name string) ([]*net.IPNet, error) {
+	decl, ok := env.GetDeclaration(name)
+
+	if !ok {
+		return nil, nil
+	}
+
+	var nets []*net.IPNet
+	items := decl.val.args
+
+	if decl.val.kind == exp {
+		items = []expr{decl.val}
+	} else if decl.val.kind != list {
+		return nil, fmt.Errorf("%s: invalid %s: expecting a list of networks but found %s instead",
+			decl.key.pos, name, decl.val)
+	}
+
+	for _, item := range items {
+		if item.kind != exp {
+			return nil, fmt.Errorf("%s: invalid %s: expecting a network but found %s instead",
+				decl.key.pos, name, item)
+		}
+
+		parsed, err := parseCIDRs([]string{item.Value()})
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid %s: %v", item.val.pos, name, err)
+		}
+
+		nets = append(nets, parsed...)
+	}
+
+	return nets, nil
 }
 
 func (env environement) GetValue(name string) (expr, bool) {
+	decl, ok := env.GetDeclaration(name)
+	return decl.val, ok
+}
+
+func (env environement) GetDeclaration(name string) (declaration, bool) {
 	for _, decl := range env.declarations {
 		if decl.key.lexeme == name {
-			return decl.val, true
+			return decl, true
 		}
 	}
 
-	return expr{}, false
+	return declaration{}, false
 }
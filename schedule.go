@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layouts accepted by Between, from most to least precise. Times without a
+// zone are in UTC.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// betweenMatcher matches requests made from the start of a window of time up
+// to, but not including, its end.
+type betweenMatcher struct {
+	start time.Time
+	end   time.Time
+	now   func() time.Time
+}
+
+// cronMatcher matches requests made while a recurring window of time is
+// open. Windows open on the schedule of a cron expression and stay open for a
+// fixed duration.
+type cronMatcher struct {
+	schedule cronSchedule
+	duration time.Duration
+	loc      *time.Location
+	now      func() time.Time
+}
+
+// cronSchedule holds the values allowed by each field of a cron expression:
+// minute, hour, day of the month, month, and day of the week.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays []bool
+	anyDay, anyWeekday                     bool
+}
+
+func newBetweenMatcher(args ...string) (matcher, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("expecting a start and an end time")
+	}
+
+	start, err := parseTime(args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := parseTime(args[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !end.After(start) {
+		return nil, fmt.Errorf("end time %v is not after start time %v", args[1], args[0])
+	}
+
+	return betweenMatcher{start: start, end: end, now: time.Now}, nil
+}
+
+func newCronMatcher(args ...string) (matcher, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return nil, fmt.Errorf("expecting a cron expression, a duration, and an optional time zone")
+	}
+
+	schedule, err := parseCron(args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	duration, err := time.ParseDuration(args[1])
+
+	if err != nil || duration <= 0 {
+		return nil, fmt.Errorf("invalid duration: %v", args[1])
+	}
+
+	loc := time.UTC
+
+	if len(args) == 3 {
+		if loc, err = time.LoadLocation(args[2]); err != nil {
+			return nil, fmt.Errorf("invalid time zone: %v", args[2])
+		}
+	}
+
+	return cronMatcher{
+		schedule: schedule,
+		duration: duration,
+		loc:      loc,
+		now:      time.Now,
+	}, nil
+}
+
+func (b betweenMatcher) Match(r http.Request) bool {
+	now := b.now()
+	return !now.Before(b.start) && now.Before(b.end)
+}
+
+// A window is open when the schedule last fired less than its duration ago.
+func (c cronMatcher) Match(r http.Request) bool {
+	now := c.now().In(c.loc)
+	_, ok := c.schedule.prev(now, now.Add(-c.duration))
+	return ok
+}
+
+// Finds the last time at or before t that the schedule fires, as long as it
+// is after the limit. Whole months, days, and hours that do not match are
+// skipped at once, so this takes at most a step for every day between the
+// limit and t plus a few for the minutes of the hours that match.
+func (s cronSchedule) prev(t, limit time.Time) (time.Time, bool) {
+	loc := t.Location()
+	t = t.Truncate(time.Minute)
+
+	for t.After(limit) {
+		year, month, day := t.Date()
+		next := t.Add(-time.Minute)
+
+		switch {
+		case !s.months[month]:
+			next = time.Date(year, month, 1, 0, 0, 0, 0, loc).Add(-time.Minute)
+		case !s.matchesDay(t):
+			next = time.Date(year, month, day, 0, 0, 0, 0, loc).Add(-time.Minute)
+		case !s.hours[t.Hour()]:
+			next = time.Date(year, month, day, t.Hour(), 0, 0, 0, loc).Add(-time.Minute)
+		case s.minutes[t.Minute()]:
+			return t, true
+		}
+
+		// Around daylight saving time changes the start of a day or an hour
+		// can be ambiguous, or not exist at all, so the jump may not go back.
+		if !next.Before(t) {
+			next = t.Add(-time.Minute)
+		}
+
+		t = next
+	}
+
+	return time.Time{}, false
+}
+
+func (s cronSchedule) matchesDay(t time.Time) bool {
+	day := s.days[t.Day()]
+	weekday := s.weekdays[t.Weekday()]
+
+	// Like cron, a day has to match either field when both are restricted,
+	// and both of them otherwise.
+	if s.anyDay || s.anyWeekday {
+		return day && weekday
+	}
+
+	return day || weekday
+}
+
+func parseTime(val string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, val); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time: %v", val)
+}
+
+// Parses a standard five field cron expression. Fields can be `*`, numbers,
+// ranges like `1-5`, steps like `*/15` or `0-30/10`, and lists of any of
+// those separated by commas.
+func parseCron(expr string) (cronSchedule, error) {
+	var s cronSchedule
+	var err error
+
+	fields := strings.Fields(expr)
+
+	if len(fields) != 5 {
+		return s, fmt.Errorf("expecting five fields in cron expression: %v", expr)
+	}
+
+	if s.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return s, err
+	} else if s.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return s, err
+	} else if s.days, err = parseCronField(fields[2], 1, 31); err != nil {
+		return s, err
+	} else if s.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return s, err
+	} else if s.weekdays, err = parseCronField(fields[4], 0, 7); err != nil {
+		return s, err
+	}
+
+	// Both 0 and 7 are Sunday. Like cron, a day field starting with `*`, even
+	// with a step, does not count as restricting the day.
+	s.weekdays[0] = s.weekdays[0] || s.weekdays[7]
+	s.anyDay = strings.HasPrefix(fields[2], "*")
+	s.anyWeekday = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+func parseCronField(field string, min, max int) ([]bool, error) {
+	allowed := make([]bool, max+1)
+
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+
+		if i := strings.Index(part, "/"); i != -1 {
+			n, err := strconv.Atoi(part[i+1:])
+
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step in cron field: %v", field)
+			}
+
+			rng, step = part[:i], n
+		}
+
+		lo, hi := min, max
+
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid cron field: %v", field)
+			}
+
+			hi = lo
+
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid cron field: %v", field)
+				}
+			} else if step != 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("cron field out of range: %v", field)
+		}
+
+		for i := lo; i <= hi; i += step {
+			allowed[i] = true
+		}
+	}
+
+	return allowed, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func fixedClock(t time.Time) func() time.Time {
+	return func() time.Time { return t }
+}
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+
+	if err != nil {
+		t.Skipf("time zone %v is not available: %v", name, err)
+	}
+
+	return loc
+}
+
+func TestBetweenMatcher(t *testing.T) {
+	m, err := newBetweenMatcher("2026-10-19T09:00:00Z", "2026-10-19T17:00:00Z")
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		now  string
+		want bool
+	}{
+		{"2026-10-19T08:59:59Z", false},
+		{"2026-10-19T09:00:00Z", true},
+		{"2026-10-19T12:00:00Z", true},
+		{"2026-10-19T16:59:59Z", true},
+		{"2026-10-19T17:00:00Z", false},
+		{"2026-10-19T11:00:00+02:00", true},
+		{"2026-10-19T11:00:00-08:00", false},
+	}
+
+	for _, test := range tests {
+		now, _ := time.Parse(time.RFC3339, test.now)
+		between := m.(betweenMatcher)
+		between.now = fixedClock(now)
+
+		if got := between.Match(http.Request{}); got != test.want {
+			t.Errorf("Between at %v: got %v, want %v", test.now, got, test.want)
+		}
+	}
+}
+
+func TestCronMatcher(t *testing.T) {
+	tests := []struct {
+		args []string
+		now  string
+		want bool
+	}{
+		// Windows open on the minute and close after their duration.
+		{[]string{"0 9 * * 1-5", "1h"}, "2026-10-19T08:59:59Z", false},
+		{[]string{"0 9 * * 1-5", "1h"}, "2026-10-19T09:00:00Z", true},
+		{[]string{"0 9 * * 1-5", "1h"}, "2026-10-19T09:59:59Z", true},
+		{[]string{"0 9 * * 1-5", "1h"}, "2026-10-19T10:00:00Z", false},
+		{[]string{"0 9 * * 1-5", "1h"}, "2026-10-18T09:30:00Z", false},
+		{[]string{"*/15 * * * *", "5m"}, "2026-10-19T10:44:59Z", false},
+		{[]string{"*/15 * * * *", "5m"}, "2026-10-19T10:45:00Z", true},
+		{[]string{"*/15 * * * *", "5m"}, "2026-10-19T10:49:59Z", true},
+		{[]string{"*/15 * * * *", "5m"}, "2026-10-19T10:50:00Z", false},
+
+		// Windows carry over into the next day, month, and year.
+		{[]string{"30 23 31 12 *", "1h"}, "2027-01-01T00:29:59Z", true},
+		{[]string{"30 23 31 12 *", "1h"}, "2027-01-01T00:30:00Z", false},
+		{[]string{"0 0 1 1 *", "8760h"}, "2026-12-31T23:59:00Z", true},
+		{[]string{"0 0 1 1 *", "24h"}, "2026-12-31T23:59:00Z", false},
+
+		// With both day fields restricted either one has to match.
+		{[]string{"0 0 13 * 5", "24h"}, "2026-10-13T12:00:00Z", true},
+		{[]string{"0 0 13 * 5", "24h"}, "2026-10-16T12:00:00Z", true},
+		{[]string{"0 0 13 * 5", "24h"}, "2026-10-14T12:00:00Z", false},
+
+		// A day field starting with `*` does not count as restricting the
+		// day, even with a step, so both fields have to match.
+		{[]string{"0 0 13 * */1", "24h"}, "2026-10-13T12:00:00Z", true},
+		{[]string{"0 0 13 * */1", "24h"}, "2026-10-16T12:00:00Z", false},
+		{[]string{"0 0 */1 * 5", "24h"}, "2026-10-13T12:00:00Z", false},
+		{[]string{"0 0 */1 * 5", "24h"}, "2026-10-16T12:00:00Z", true},
+		{[]string{"0 0 */2 * 5", "24h"}, "2026-10-09T12:00:00Z", true},
+		{[]string{"0 0 */2 * 5", "24h"}, "2026-10-15T12:00:00Z", false},
+		{[]string{"0 0 */2 * 5", "24h"}, "2026-10-16T12:00:00Z", false},
+
+		// Time zones.
+		{[]string{"0 9 * * *", "1h", "Asia/Tokyo"}, "2026-10-19T00:30:00Z", true},
+		{[]string{"0 9 * * *", "1h", "Asia/Tokyo"}, "2026-10-19T09:30:00Z", false},
+	}
+
+	for _, test := range tests {
+		m, err := newCronMatcher(test.args...)
+
+		if err != nil {
+			t.Fatalf("Cron%v: unexpected error: %v", test.args, err)
+		}
+
+		now, _ := time.Parse(time.RFC3339, test.now)
+		cron := m.(cronMatcher)
+		cron.now = fixedClock(now)
+
+		if got := cron.Match(http.Request{}); got != test.want {
+			t.Errorf("Cron%v at %v: got %v, want %v", test.args, test.now, got, test.want)
+		}
+	}
+}
+
+// The window's duration is real time, so it is an hour shorter by the wall
+// clock when the clocks go forward during it.
+func TestCronMatcherDaylightSavingTime(t *testing.T) {
+	loc := mustLoadLocation(t, "America/Chicago")
+
+	tests := []struct {
+		args []string
+		now  time.Time
+		want bool
+	}{
+		{[]string{"0 0 * * *", "3h", "America/Chicago"}, time.Date(2026, 3, 8, 3, 30, 0, 0, loc), true},
+		{[]string{"0 0 * * *", "3h", "America/Chicago"}, time.Date(2026, 3, 8, 4, 30, 0, 0, loc), false},
+		{[]string{"0 0 * * *", "3h", "America/Chicago"}, time.Date(2026, 11, 1, 1, 30, 0, 0, loc).Add(time.Hour), true},
+		{[]string{"0 0 * * *", "3h", "America/Chicago"}, time.Date(2026, 11, 1, 2, 30, 0, 0, loc), false},
+		{[]string{"0 3 * * *", "30m", "America/Chicago"}, time.Date(2026, 3, 8, 3, 15, 0, 0, loc), true},
+		{[]string{"0 1 * * *", "30m", "America/Chicago"}, time.Date(2026, 11, 1, 1, 15, 0, 0, loc).Add(time.Hour), true},
+	}
+
+	for _, test := range tests {
+		m, err := newCronMatcher(test.args...)
+
+		if err != nil {
+			t.Fatalf("Cron%v: unexpected error: %v", test.args, err)
+		}
+
+		cron := m.(cronMatcher)
+		cron.now = fixedClock(test.now)
+
+		if got := cron.Match(http.Request{}); got != test.want {
+			t.Errorf("Cron%v at %v: got %v, want %v", test.args, test.now, got, test.want)
+		}
+	}
+}
+
+// Checks the schedule against walking back from now one minute at a time.
+func TestCronMatcherMatchesMinuteWalk(t *testing.T) {
+	loc := mustLoadLocation(t, "America/Chicago")
+
+	schedules := []string{
+		"* * * * *",
+		"0 9 * * 1-5",
+		"*/7 */5 * * *",
+		"59 23 31 * *",
+		"0 0 13 * 5",
+		"30 2 * 3,11 0",
+		"15 1 1 1 *",
+		"0 12 */2 * 1",
+	}
+
+	start := time.Date(2026, 2, 27, 0, 0, 0, 0, loc)
+
+	for _, expr := range schedules {
+		schedule, err := parseCron(expr)
+
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", expr, err)
+		}
+
+		for now := start; now.Before(start.AddDate(1, 0, 0)); now = now.Add(197 * time.Minute) {
+			limit := now.Add(-36 * time.Hour)
+			want := time.Time{}
+
+			for t := now.Truncate(time.Minute); t.After(limit); t = t.Add(-time.Minute) {
+				if schedule.matchesDay(t) && schedule.minutes[t.Minute()] &&
+					schedule.hours[t.Hour()] && schedule.months[t.Month()] {
+					want = t
+					break
+				}
+			}
+
+			if got, _ := schedule.prev(now, limit); !got.Equal(want) {
+				t.Fatalf("%v at %v: got %v, want %v", expr, now, got, want)
+			}
+		}
+	}
+}
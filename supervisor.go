@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// generation is one fully built configuration: the servers created from a
+// Servfile and the environment they were created in. A generation is never
+// modified once it is created, reloads build a new one instead. Background
+// work started for a generation is tied to its context and stops once the
+// generation is replaced.
+type generation struct {
+	id       int
+	servers  []server
+	env      environement
+	domains  []string
+	notFound http.Handler
+	table    routingTable
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// supervisor is the top-level handler that hands requests over to the
+// servers in the generation that is currently live. Swapping generations is
+// safe while requests are being served, and a request that is already being
+// handled finishes on the generation it started on.
+type supervisor struct {
+	ctx     context.Context
+	current atomic.Value
+	active  sync.WaitGroup
+}
+
+func (s *supervisor) load() *generation {
+	gen, _ := s.current.Load().(*generation)
+	return gen
+}
+
+func newGeneration(parent context.Context) *generation {
+	ctx, cancel := context.WithCancel(parent)
+
+	return &generation{
+		id:     1,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Puts a new generation in place and stops the one it replaced, if any. The
+// replaced generation is returned.
+func (s *supervisor) swap(next *generation) *generation {
+	prev := s.load()
+
+	if prev != nil {
+		next.id = prev.id + 1
+	}
+
+	s.current.Store(next)
+
+	if prev != nil {
+		prev.cancel()
+	}
+
+	return prev
+}
+
+// Waits for every request that is being handled to finish, including those
+// on hijacked connections like websockets, or until the context is done.
+func (s *supervisor) drain(ctx context.Context) error {
+	done := make(chan struct{})
+
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *supervisor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.active.Add(1)
+	defer s.active.Done()
+
+	gen := s.load()
+
+	if gen == nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable),
+			http.StatusServiceUnavailable)
+		return
+	}
+
+	for _, i := range gen.table.candidates(r.Host) {
+		server := gen.servers[i]
+
+		if server.Matcher.Match(*r) {
+			if c, ok := server.Matcher.(capturer); ok {
+				r = withCaptures(r, c.captures(*r))
+			}
+
+			server.Mux.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	warn("no matches found for %v%v", r.Host, r.URL.Path)
+	gen.notFound.ServeHTTP(w, r)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// routingTable narrows down the servers that could handle a request based on
+// its host, so that only those have to be checked. Servers whose matchers pin
+// the host down to an exact value are indexed by it, those that match any
+// host under a domain are kept in a trie of domain labels, and everything
+// else is checked for every request. Servers are always checked in the order
+// they were declared in.
+type routingTable struct {
+	exact    map[string][]int
+	suffixes *suffixNode
+	generic  []int
+}
+
+// suffixNode is a node in a trie of reversed host labels, so `minond.xyz` is
+// found under `xyz` and then `minond`. Servers in star match hosts with
+// exactly one more label than the node, and servers in any match the node
+// and everything under it.
+type suffixNode struct {
+	children map[string]*suffixNode
+	star     []int
+	any      []int
+}
+
+// hostKey is one way a matcher restricts the hosts it matches.
+type hostKey struct {
+	exact  string
+	suffix []string
+	star   bool
+}
+
+func newSuffixNode() *suffixNode {
+	return &suffixNode{children: make(map[string]*suffixNode)}
+}
+
+func newRoutingTable(servers []server) routingTable {
+	table := routingTable{
+		exact:    make(map[string][]int),
+		suffixes: newSuffixNode(),
+	}
+
+	for i, server := range servers {
+		keys, ok := hostKeys(server.Matcher)
+
+		if !ok {
+			table.generic = append(table.generic, i)
+			continue
+		}
+
+		for _, key := range keys {
+			if key.exact != "" {
+				table.exact[key.exact] = append(table.exact[key.exact], i)
+				continue
+			}
+
+			node := table.suffixes.insert(key.suffix)
+
+			if key.star {
+				node.star = append(node.star, i)
+			} else {
+				node.any = append(node.any, i)
+			}
+		}
+	}
+
+	// Requests for exact hosts are the common case so their candidates are
+	// worked out ahead of time.
+	for host := range table.exact {
+		table.exact[host] = table.lookup(host)
+	}
+
+	return table
+}
+
+// Returns the index of every server that could match a request for the host,
+// in the order the servers should be checked.
+func (t routingTable) candidates(host string) []int {
+	host = hostname(host)
+
+	if indexes, ok := t.exact[host]; ok {
+		return indexes
+	}
+
+	return t.lookup(host)
+}
+
+func (t routingTable) lookup(host string) []int {
+	labels := strings.Split(host, ".")
+	indexes := append([]int{}, t.exact[host]...)
+	indexes = append(indexes, t.generic...)
+	node := t.suffixes
+
+	for i := len(labels) - 1; i >= 0 && node != nil; i-- {
+		indexes = append(indexes, node.any...)
+
+		if i == 0 {
+			indexes = append(indexes, node.star...)
+		}
+
+		node = node.children[labels[i]]
+	}
+
+	if node != nil {
+		indexes = append(indexes, node.any...)
+	}
+
+	return uniqueInts(indexes)
+}
+
+func (n *suffixNode) insert(labels []string) *suffixNode {
+	node := n
+
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+
+		if !ok {
+			child = newSuffixNode()
+			node.children[labels[i]] = child
+		}
+
+		node = child
+	}
+
+	return node
+}
+
+// Works out which hosts a matcher can match, if that can be narrowed down at
+// all. Every host the matcher matches must be covered by one of the keys but
+// not every host covered by a key has to match, since the matcher is still
+// checked.
+func hostKeys(m matcher) ([]hostKey, bool) {
+	switch m := m.(type) {
+	case hostMatcher:
+		if m.domain.concrete() && m.tld.concrete() {
+			suffix := strings.Split(joinLabels(m.domain.value, m.tld.value), ".")
+
+			if m.subdomain.concrete() {
+				return []hostKey{{exact: joinLabels(m.subdomain.value, m.domain.value, m.tld.value)}}, true
+			}
+
+			return []hostKey{{suffix: suffix}}, true
+		}
+
+	case hostPatternMatcher:
+		labels := strings.Split(m.pattern.value, ".")
+
+		if m.pattern.concrete() {
+			return []hostKey{{exact: m.pattern.value}}, true
+		} else if len(labels) > 1 && labels[0] == "*" && value(strings.Join(labels[1:], ".")).concrete() {
+			return []hostKey{{suffix: labels[1:], star: true}}, true
+		}
+
+	case orMatcher:
+		var keys []hostKey
+
+		for _, child := range m.matchers {
+			childKeys, ok := hostKeys(child)
+
+			if !ok {
+				return nil, false
+			}
+
+			keys = append(keys, childKeys...)
+		}
+
+		return keys, true
+
+	case andMatcher:
+		for _, child := range m.matchers {
+			if keys, ok := hostKeys(child); ok {
+				return keys, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+func uniqueInts(vals []int) []int {
+	sort.Ints(vals)
+	unique := vals[:0]
+
+	for i, val := range vals {
+		if i == 0 || val != vals[i-1] {
+			unique = append(unique, val)
+		}
+	}
+
+	return unique
+}
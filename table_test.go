@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+const tableServfile = `
+case Host(localhost) =>
+  path / status(200)
+
+case Host(www, minond, xyz) =>
+  path / status(200)
+
+case And(Host(api, minond, xyz), Method(POST)) =>
+  path / status(200)
+
+case Host(*.minond.xyz) =>
+  path / status(200)
+
+case Host(_, minond, co.uk) =>
+  path / status(200)
+
+case Host(api-*.example.com) =>
+  path / status(200)
+
+case Or(Host(a.other.org), Host(*.*.other.org)) =>
+  path / status(200)
+
+case Host(www, _, _) =>
+  path / status(200)
+
+case Method(DELETE) =>
+  path / status(200)
+
+case Host(127.0.0.1) =>
+  path / status(200)
+
+case Not(Host(_, example, com)) =>
+  path / status(200)
+
+default =>
+  path / status(200)
+`
+
+func TestRoutingTableMatchesLinearScan(t *testing.T) {
+	_, matches, errs := parse(tableServfile)
+
+	if len(errs) != 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	servers, _, compileErrs := compile(newEnvironment(nil), matches)
+
+	if len(compileErrs) != 0 {
+		t.Fatalf("unexpected compile errors: %v", compileErrs)
+	}
+
+	table := newRoutingTable(servers)
+
+	hosts := []string{
+		"localhost",
+		"localhost:8080",
+		"LocalHost.",
+		"minond.xyz",
+		"www.minond.xyz",
+		"WWW.Minond.XYZ.",
+		"www.minond.xyz:443",
+		"api.minond.xyz",
+		"a.b.minond.xyz",
+		"minond.co.uk",
+		"www.minond.co.uk",
+		"a.b.minond.co.uk",
+		"api-1.example.com",
+		"API-2.EXAMPLE.COM:80",
+		"api.example.com",
+		"example.com",
+		"a.other.org",
+		"b.other.org",
+		"a.b.other.org",
+		"www.example.org",
+		"www.co.uk",
+		"127.0.0.1",
+		"127.0.0.1:8080",
+		"[::1]:8080",
+		"unknown",
+		"",
+	}
+
+	methods := []string{http.MethodGet, http.MethodPost, http.MethodDelete}
+
+	for _, host := range hosts {
+		for _, method := range methods {
+			r := http.Request{Host: host, Method: method}
+			want := -1
+			got := -1
+
+			for i, server := range servers {
+				if server.Matcher.Match(r) {
+					want = i
+					break
+				}
+			}
+
+			for _, i := range table.candidates(host) {
+				if servers[i].Matcher.Match(r) {
+					got = i
+					break
+				}
+			}
+
+			if got != want {
+				t.Errorf("%s %s: table picked case %d but a linear scan picked %d", method, host, got, want)
+			}
+		}
+	}
+}
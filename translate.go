@@ -1,101 +1,524 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
-// Runtime takes parsed declarations and matches and builds the working http
-// handlers and an environment.
-func runtime(decls []declaration, matches []match) ([]server, environement) {
+// Runtime takes parsed declarations and matches and builds a generation with
+// the working http handlers and an environment. Nothing is returned as usable
+// when an error is found, but every problem is collected before giving up so
+// they can all be reported at once. Any background work started by the
+// handlers runs until the generation is stopped.
+func runtime(parent context.Context, decls []declaration, matches []match) (*generation, error) {
+	gen := newGeneration(parent)
+	gen.env = newEnvironment(decls)
+	servers, fallback, errs := compile(gen.env, matches)
+	notFound, err := buildFallback(gen.ctx, fallback, http.NotFoundHandler())
+	errs = errs.add(err)
+
+	for i := range servers {
+		servers[i].notFound, err = buildFallback(gen.ctx, servers[i].fallback, notFound)
+		errs = errs.add(err)
+
+		for j := range servers[i].routes {
+			servers[i].routes[j].notFound = servers[i].notFound
+		}
+
+		servers[i].Mux, err = buildMux(gen.ctx, servers[i].routes, servers[i].notFound)
+		errs = errs.add(err)
+	}
+
+	if len(errs) != 0 {
+		gen.cancel()
+		return nil, errs
+	}
+
+	gen.servers = servers
+	gen.notFound = notFound
+	gen.table = newRoutingTable(servers)
+	return gen, nil
+}
+
+// Compile checks the declarations and resolves the matcher and routes of
+// every case without creating any of the handlers, so it has no side effects.
+// The top-level not found route is returned when there is one.
+func compile(env environement, matches []match) ([]server, *route, errorList) {
 	var servers []server
-	env := newEnvironment(decls)
+	var defaults []server
+	var errs errorList
+
+	if _, err := env.GetDuration("shutdown_timeout", defaultShutdownTimeout); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := env.GetNetworks("trusted_proxies"); err != nil {
+		errs = append(errs, err)
+	}
+
+	notFound, err := defToRoute(env, env.declarations, "not_found")
+
+	if err != nil {
+		errs = append(errs, err)
+	}
 
 	for _, match := range matches {
 		var routes []route
+		var defs []declaration
+
+		var matcher matcher = anyMatcher{}
 
 		info("generating %s", match.expr)
 
+		if !match.isDefault {
+			matcher, err = exprToMatch(env, match.expr)
+
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+
 		for _, decl := range match.decls {
 			info("mounting %s", decl)
 
 			switch decl.kind {
 			case path:
-				routes = append(routes, declToRoute(env, decl))
+				route, err := declToRoute(env, decl)
+
+				if err != nil {
+					errs = append(errs, err)
+				} else {
+					routes = append(routes, route)
+				}
+
+			case def:
+				if decl.key.lexeme != "not_found" {
+					warn("unknown definition in case: %s", decl.key.lexeme)
+				}
+
+				defs = append(defs, decl)
 
 			default:
 				warn("unknown declaration kind: %s", decl.kind)
 			}
 		}
 
+		fallback, err := defToRoute(env, defs, "not_found")
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+
 		server := server{
-			routes: routes,
-			Match:  exprToMatch(env, match.expr),
-			Mux:    buildMux(routes),
+			expr:      match.expr,
+			routes:    routes,
+			fallback:  fallback,
+			isDefault: match.isDefault,
+			Matcher:   matcher,
 		}
 
-		servers = append(servers, server)
+		if match.isDefault {
+			defaults = append(defaults, server)
+		} else {
+			servers = append(servers, server)
+		}
 	}
 
-	return servers, env
+	// The default block is always evaluated last, no matter where it is.
+	for i, server := range defaults {
+		if i > 0 {
+			errs = append(errs, fmt.Errorf("%s: only one default block is allowed",
+				server.expr.val.pos))
+		}
+	}
+
+	servers = append(servers, defaults...)
+
+	return servers, notFound, errs
 }
 
-func buildMux(routes []route) *http.ServeMux {
+// Builds a mux with every route mounted in it. Requests that no route's path
+// matches go to the not found handler, which is mounted at the root when no
+// route is, so that the mux still gets to redirect requests with unclean
+// paths or missing trailing slashes.
+func buildMux(ctx context.Context, routes []route, notFound http.Handler) (*http.ServeMux, error) {
+	var errs errorList
+	var paths []string
 	mux := http.NewServeMux()
+	conditional := make(map[string][]route)
+	dispatchers := make(map[string]*dispatcher)
+
+	for _, r := range routes {
+		if _, ok := conditional[r.path]; r.matcher != nil && !ok {
+			paths = append(paths, r.path)
+			conditional[r.path] = nil
+		}
+	}
 
 	for _, route := range routes {
+		if group, ok := conditional[route.path]; ok {
+			conditional[route.path] = append(group, route)
+			continue
+		}
+
 		info("creating handler for %v", route.path)
-		route.handler.constructor(route, mux)
+
+		if err := mount(ctx, route, mux); err != nil {
+			errs = append(errs, fmt.Errorf("%s: error creating handler for %v: %v",
+				route.pos, route.path, err))
+		}
+	}
+
+	for _, path := range paths {
+		errs = errs.add(mountConditional(ctx, conditional[path], mux, dispatchers))
+	}
+
+	if len(errs) != 0 {
+		return nil, errs
+	}
+
+	if !registered(mux, "/") {
+		mux.Handle("/", notFound)
+	}
+
+	var patterns []string
+
+	for _, route := range routes {
+		patterns = append(patterns, route.path, route.path+"/")
+	}
+
+	for pattern, d := range dispatchers {
+		d.next = fallthroughMux(mux, pattern, patterns, dispatchers, notFound)
 	}
 
-	return mux
+	return mux, nil
 }
 
-func exprToMatch(env environement, expr expr) func(http.Request) bool {
-	if expr.kind != call {
-		fatal("Expecting a call but found %s instead", expr.kind)
+// Builds the mux that requests for a pattern go to when they do not match the
+// condition of any of its routes. It has the handlers the mux would have
+// picked if the routes with conditions for the pattern's path were not there.
+// Only shorter patterns can match those requests, other than the pattern with
+// a trailing slash, which the mux redirects to when a route without a
+// condition registered it. Since every mux along the way only has shorter
+// patterns, a request can never come back to the same one.
+func fallthroughMux(mux *http.ServeMux, pattern string, patterns []string, dispatchers map[string]*dispatcher, notFound http.Handler) *http.ServeMux {
+	next := http.NewServeMux()
+	seen := make(map[string]bool)
+
+	for _, p := range patterns {
+		if seen[p] || (len(p) >= len(pattern) && p != pattern+"/") {
+			continue
+		} else if d, ok := dispatchers[p]; ok && d.path == dispatchers[pattern].path && !d.unconditional {
+			continue
+		} else if handler, ok := handlerFor(mux, p); ok {
+			next.Handle(p, handler)
+			seen[p] = true
+		}
 	}
 
-	var matcher matcher
-	var args []string
+	if !seen["/"] {
+		next.Handle("/", notFound)
+	}
+
+	return next
+}
+
+// Runs a route's handler constructor. http.ServeMux panics when a path is
+// registered more than once so that is reported as an error too.
+func mount(ctx context.Context, route route, mux *http.ServeMux) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	return route.handler.constructor(ctx, route, mux)
+}
+
+// Mounts routes that share a path when at least one of them only handles
+// requests matching a condition. Every route gets a mux of its own and
+// requests are passed to the first route whose condition they match, with the
+// route that has no condition, if there is one, tried last. Requests that no
+// route matches fall through to the rest of the mux, which is only known once
+// every route is mounted, so the dispatchers are collected for later.
+func mountConditional(ctx context.Context, routes []route, mux *http.ServeMux, dispatchers map[string]*dispatcher) (err error) {
+	var errs errorList
+	var ordered []route
+	var unconditional []route
+
+	for _, route := range routes {
+		if route.matcher != nil {
+			ordered = append(ordered, route)
+		} else {
+			unconditional = append(unconditional, route)
+		}
+	}
+
+	if len(unconditional) > 1 {
+		return fmt.Errorf("%s: error creating handler for %v: path already has a route without a condition",
+			unconditional[1].pos, unconditional[1].path)
+	}
+
+	ordered = append(ordered, unconditional...)
+	muxes := make([]*http.ServeMux, len(ordered))
+
+	for i, route := range ordered {
+		info("creating handler for %v", route.path)
+		muxes[i] = http.NewServeMux()
+
+		if err := mount(ctx, route, muxes[i]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: error creating handler for %v: %v",
+				route.pos, route.path, err))
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: error creating handler for %v: %v",
+				ordered[0].pos, ordered[0].path, r)
+		}
+	}()
+
+	// Handlers register the route's path, its path with a trailing slash, or
+	// both, and the mux sends requests to the routes that registered the same.
+	patterns := []string{ordered[0].path}
+
+	if !strings.HasSuffix(ordered[0].path, "/") {
+		patterns = append(patterns, ordered[0].path+"/")
+	}
+
+	for _, pattern := range patterns {
+		var candidates []int
+		unconditional := false
+
+		for i := range ordered {
+			if registered(muxes[i], pattern) {
+				candidates = append(candidates, i)
+				unconditional = unconditional || ordered[i].matcher == nil
+			}
+		}
+
+		if len(candidates) != 0 {
+			d := &dispatcher{
+				path:          ordered[0].path,
+				routes:        ordered,
+				muxes:         muxes,
+				candidates:    candidates,
+				unconditional: unconditional,
+			}
+
+			mux.Handle(pattern, d)
+			dispatchers[pattern] = d
+		}
+	}
+
+	return nil
+}
+
+// dispatcher passes requests for a pattern to the first of its routes whose
+// condition they match, and to the next handler when they match none. A
+// dispatcher is unconditional when one of its routes has no condition, so
+// that every request is handled by one of them.
+type dispatcher struct {
+	path          string
+	routes        []route
+	muxes         []*http.ServeMux
+	candidates    []int
+	unconditional bool
+	next          http.Handler
+}
+
+func (d *dispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, i := range d.candidates {
+		m := d.routes[i].matcher
+
+		if m != nil && !m.Match(*r) {
+			continue
+		} else if c, ok := m.(capturer); ok {
+			r = withCaptures(r, c.captures(*r))
+		}
+
+		d.muxes[i].ServeHTTP(w, r)
+		return
+	}
+
+	d.next.ServeHTTP(w, r)
+}
+
+// Checks if a pattern was registered in a mux as-is.
+func registered(mux *http.ServeMux, pattern string) bool {
+	_, ok := handlerFor(mux, pattern)
+	return ok
+}
+
+// Returns the handler registered in a mux for a pattern as-is.
+func handlerFor(mux *http.ServeMux, pattern string) (http.Handler, bool) {
+	handler, found := mux.Handler(&http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: pattern},
+	})
+
+	return handler, found == pattern
+}
+
+func exprToMatch(env environement, expr expr) (matcher, error) {
+	if expr.kind != call {
+		return nil, fmt.Errorf("%s: expecting a call but found %s instead",
+			expr.val.pos, expr.kind)
+	}
 
 	def, ok := env.matchers[expr.val.lexeme]
 
-	if ok && def.arity != len(expr.args) {
-		fatal("Wrong number of arguments for %s. Expected %d but got %d.",
-			expr.val.lexeme, def.arity, len(expr.args))
-		matcher = nullMatcher{}
-	} else if !ok {
-		warn("unknown matcher kind: %s", expr.val.lexeme)
-		matcher = nullMatcher{}
-	} else {
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown matcher kind: %s",
+			expr.val.pos, expr.val.lexeme)
+	} else if def.arity != variadic && def.arity != len(expr.args) {
+		return nil, fmt.Errorf("%s: wrong number of arguments for %s. Expected %d but got %d.",
+			expr.val.pos, expr.val.lexeme, def.arity, len(expr.args))
+	}
+
+	var m matcher
+	var err error
+
+	if def.combinator != nil {
+		var children []matcher
+		var errs errorList
+
 		for _, arg := range expr.args {
-			args = append(args, arg.lexeme)
+			child, err := exprToMatch(env, arg)
+			errs = errs.add(err)
+			children = append(children, child)
 		}
 
-		matcher = def.constructor(args...)
+		if len(errs) != 0 {
+			return nil, errs
+		}
+
+		m, err = def.combinator(children...)
+	} else {
+		args, argErr := exprValues(expr.args)
+
+		if argErr != nil {
+			return nil, argErr
+		}
+
+		m, err = def.constructor(args...)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid %s: %v", expr.val.pos, expr, err)
+	}
+
+	return m, nil
+}
+
+// Turns a call's arguments into strings, which only works when none of them
+// are calls themselves.
+func exprValues(exprs []expr) ([]string, error) {
+	var vals []string
+
+	for _, e := range exprs {
+		if e.kind != exp {
+			return nil, fmt.Errorf("%s: expecting a value but found %s instead",
+				e.val.pos, e)
+		}
+
+		vals = append(vals, e.val.lexeme)
+	}
+
+	return vals, nil
+}
+
+// Turns a definition whose value is a handler, like `def not_found dir(.)`,
+// into a route mounted at the root.
+func defToRoute(env environement, decls []declaration, name string) (*route, error) {
+	for _, decl := range decls {
+		if decl.kind != def || decl.key.lexeme != name {
+			continue
+		}
+
+		route, err := declToRoute(env, declaration{
+			kind: path,
+			key:  tok(identifierToken, "/", decl.key.pos),
+			val:  decl.val,
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &route, nil
+	}
+
+	return nil, nil
+}
+
+// Builds the handler for a not found route. Whatever the route responds with
+// is sent with a 404 status. Requests the route itself cannot find anything
+// for are passed on to the next handler.
+func buildFallback(ctx context.Context, fallback *route, next http.Handler) (http.Handler, error) {
+	if fallback == nil {
+		return next, nil
 	}
 
-	return func(r http.Request) bool {
-		return matcher.Match(r)
+	fallback.notFound = next
+	fallback.notFoundPage = true
+	mux, err := buildMux(ctx, []route{*fallback}, next)
+
+	if err != nil {
+		return nil, err
 	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(&statusWriter{ResponseWriter: w, status: http.StatusNotFound}, r)
+	}), nil
 }
 
-func declToRoute(env environement, decl declaration) route {
-	var args []string
+func declToRoute(env environement, decl declaration) (route, error) {
 	handler, ok := env.handlers[decl.val.val.lexeme]
 
 	if !ok {
-		fatal("Invalid route kind: %s",
-			decl.val.val.lexeme)
+		return route{}, fmt.Errorf("%s: invalid route kind: %s",
+			decl.val.val.pos, decl.val.val.lexeme)
+	} else if len(decl.val.args) < handler.arity {
+		return route{}, fmt.Errorf("%s: not enough arguments for %s. Expected at least %d but got %d.",
+			decl.val.val.pos, decl.val.val.lexeme, handler.arity, len(decl.val.args))
 	}
 
-	for _, arg := range decl.val.args {
-		args = append(args, arg.lexeme)
+	args, err := exprValues(decl.val.args)
+
+	if err != nil {
+		return route{}, err
+	}
+
+	var m matcher
+
+	if decl.when != nil {
+		if m, err = exprToMatch(env, *decl.when); err != nil {
+			return route{}, err
+		}
 	}
 
-	return route{
+	r := route{
 		handler: handler,
 		path:    decl.key.lexeme,
 		data:    args,
+		pos:     decl.key.pos,
+		matcher: m,
 	}
+
+	if handler.validate != nil {
+		if err := handler.validate(r); err != nil {
+			return route{}, fmt.Errorf("%s: invalid %s: %v", decl.val.val.pos, decl.val, err)
+		}
+	}
+
+	return r, nil
 }
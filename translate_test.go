@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func echoServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", name, r.Method, r.URL.Path)
+	}))
+}
+
+func serveConfig(ctx context.Context, t *testing.T, config string) http.Handler {
+	decls, matches, errs := parse(config)
+
+	if len(errs) != 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	gen, err := runtime(ctx, decls, matches)
+
+	if err != nil {
+		t.Fatalf("unexpected runtime error: %v", err)
+	}
+
+	return gen.servers[0].Mux
+}
+
+type response struct {
+	status   int
+	location string
+	body     string
+}
+
+func get(handler http.Handler, method, path string) response {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, "http://localhost"+path, nil))
+	body, _ := ioutil.ReadAll(w.Result().Body)
+
+	return response{
+		status:   w.Code,
+		location: w.Header().Get("Location"),
+		body:     string(body),
+	}
+}
+
+// Requests that do not match the condition of any route for a path are
+// handled as if the routes with conditions were not there.
+func TestConditionalRoutesFallThrough(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := echoServer("a")
+	defer a.Close()
+	b := echoServer("b")
+	defer b.Close()
+
+	plain := serveConfig(ctx, t, fmt.Sprintf(`
+case Host(localhost) =>
+  path /api     proxy(%s)
+  path /status  status(204)
+  path /status/ status(205)
+`, a.URL))
+
+	conditional := serveConfig(ctx, t, fmt.Sprintf(`
+case Host(localhost) =>
+  path /api     proxy(%s)
+  path /api/v2  when Method(PUT) proxy(%s)
+  path /status  status(204)
+  path /status/ status(205)
+  path /status  when Method(PUT) status(202)
+  path /other   when Method(PUT) status(202)
+`, a.URL, b.URL))
+
+	methods := []string{http.MethodGet, http.MethodPost, http.MethodDelete}
+	paths := []string{
+		"/api",
+		"/api/",
+		"/api/v2",
+		"/api/v2/",
+		"/api/v2/x",
+		"/api/v3",
+		"/status",
+		"/status/x",
+		"/other",
+		"/other/",
+		"/nope",
+	}
+
+	for _, method := range methods {
+		for _, path := range paths {
+			want := get(plain, method, path)
+			got := get(conditional, method, path)
+
+			if got != want {
+				t.Errorf("%s %s: got %+v, want %+v", method, path, got, want)
+			}
+		}
+	}
+
+	tests := []struct {
+		path string
+		want response
+	}{
+		{"/api/v2", response{status: http.StatusOK, body: "b PUT /"}},
+		{"/api/v2/x", response{status: http.StatusOK, body: "b PUT /x"}},
+		{"/status", response{status: http.StatusAccepted, body: "Accepted\n"}},
+		{"/other", response{status: http.StatusAccepted, body: "Accepted\n"}},
+	}
+
+	for _, test := range tests {
+		if got := get(conditional, http.MethodPut, test.path); got != test.want {
+			t.Errorf("PUT %s: got %+v, want %+v", test.path, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+const (
+	watchDebounce     = 500 * time.Millisecond
+	watchPollInterval = 5 * time.Second
+)
+
+// Forwards events from one channel to another once no new events have come in
+// for the given wait period. Editors tend to write a file in several steps
+// (truncate, write, rename, chmod) and we only want to reload once.
+func debounce(in <-chan bool, out chan<- bool, wait time.Duration) {
+	timer := time.NewTimer(wait)
+	timer.Stop()
+
+	for {
+		select {
+		case <-in:
+			timer.Reset(wait)
+
+		case <-timer.C:
+			out <- true
+		}
+	}
+}
+
+// Checks a file for changes by comparing its modification time and size at a
+// regular interval. Used when there is no way of getting notified of changes.
+func poll(fileName string, events chan<- bool) {
+	curr, err := os.Stat(fileName)
+
+	if err != nil {
+		warn("error getting stats for %v: %v", fileName, err)
+	}
+
+	for {
+		time.Sleep(watchPollInterval)
+		next, err := os.Stat(fileName)
+
+		if err != nil {
+			warn("error getting stats for %v: %v", fileName, err)
+		} else if curr == nil || next.ModTime() != curr.ModTime() || next.Size() != curr.Size() {
+			curr = next
+			events <- true
+		}
+	}
+}
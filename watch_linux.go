@@ -0,0 +1,71 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY |
+	syscall.IN_ATTRIB | syscall.IN_CREATE | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM
+
+func watch(fileName string, ch chan bool) {
+	events := make(chan bool)
+	go debounce(events, ch, watchDebounce)
+
+	if err := inotify(fileName, events); err != nil {
+		warn("error watching %v with inotify, polling instead: %v", fileName, err)
+		poll(fileName, events)
+	}
+}
+
+// Watches the directory the file is in rather than the file itself so that
+// editors that save by writing a new file and renaming it over the old one
+// are still picked up.
+func inotify(fileName string, events chan<- bool) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+
+	if err != nil {
+		return err
+	}
+
+	defer syscall.Close(fd)
+
+	dir, name := filepath.Split(filepath.Clean(fileName))
+
+	if dir == "" {
+		dir = "."
+	}
+
+	if _, err = syscall.InotifyAddWatch(fd, dir, inotifyMask); err != nil {
+		return err
+	}
+
+	buff := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.PathMax))
+
+	for {
+		n, err := syscall.Read(fd, buff)
+
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buff[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(event.Len)
+
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				return syscall.ENOENT
+			}
+
+			if strings.TrimRight(string(buff[start:offset]), "\x00") == name {
+				events <- true
+			}
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func watch(fileName string, ch chan bool) {
+	events := make(chan bool)
+	go debounce(events, ch, watchDebounce)
+	poll(fileName, events)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Requests are split into this many buckets, which allows weights down to a
+// hundredth of a percent.
+const weightBuckets = 10000
+
+// weightMatcher matches a fixed percentage of clients. Clients are hashed
+// into a bucket by the value of a cookie, or by their address when there is
+// no cookie, so the same client always lands in the same bucket. Every
+// weightMatcher agrees on a client's bucket, which makes the percentages of
+// consecutive cases cumulative.
+type weightMatcher struct {
+	buckets uint32
+	cookie  string
+	trusted []*net.IPNet
+}
+
+func newWeightMatcher(trusted []*net.IPNet, args ...string) (matcher, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return nil, fmt.Errorf("expecting a percentage and an optional cookie name")
+	}
+
+	pct, err := strconv.ParseFloat(args[0], 64)
+
+	if err != nil || pct < 0 || pct > 100 {
+		return nil, fmt.Errorf("invalid percentage: %v", args[0])
+	}
+
+	m := weightMatcher{
+		buckets: uint32(pct * weightBuckets / 100),
+		trusted: trusted,
+	}
+
+	if len(args) == 2 {
+		m.cookie = args[1]
+	}
+
+	return m, nil
+}
+
+func (m weightMatcher) Match(r http.Request) bool {
+	return m.bucket(r) < m.buckets
+}
+
+func (m weightMatcher) bucket(r http.Request) uint32 {
+	key := ""
+
+	if m.cookie != "" {
+		key, _ = getCookie(r, m.cookie)
+	}
+
+	if key == "" {
+		if ip := clientIP(r, m.trusted); ip != nil {
+			key = ip.String()
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32() % weightBuckets
+}